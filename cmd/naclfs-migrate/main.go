@@ -0,0 +1,70 @@
+/*
+Command naclfs-migrate converts a plaintext directory tree into a naclfs
+tree in place. An interrupted migration continues where it stopped when
+the command is run again.
+
+	naclfs-migrate -key-file KEY [-block-size N] DIR
+
+The key file holds the 32 byte key, hex encoded. The tree is initialised
+with a naclfs config on the first run.
+*/
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func readKey(name string) (*[32]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("Key file %s does not hold a hex encoded 32 byte key", name)
+	}
+	key := new([32]byte)
+	copy(key[:], b)
+	return key, nil
+}
+
+func main() {
+	keyFile := flag.String("key-file", "", "file holding the hex encoded key")
+	blockSize := flag.Int64("block-size", naclfs.DefaultBlockSize, "block size of new trees")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -key-file KEY [-block-size N] DIR\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *keyFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	key, err := readKey(*keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backing := afero.NewBasePathFs(afero.NewOsFs(), flag.Arg(0))
+	if _, err := trfs.ReadConfig(backing); err == trfs.ErrNoConfig {
+		if _, err := naclfs.Init(backing, key, &naclfs.Options{BlockSize: *blockSize}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fs, err := naclfs.Open(backing, naclfs.StaticKey(key), trfs.WithMigration())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := trfs.Migrate(fs); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,10 +1,11 @@
 package transformfile
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"os"
 	"strings"
+	"syscall"
 
 	"golang.org/x/text/transform"
 )
@@ -55,13 +56,31 @@ type fileinfo struct {
 }
 
 func (i *fileinfo) Size() int64 {
-	actualSize := i.FileInfo.Size()
-	bs := i.blockSize + int64(i.overhead)
-	numBlocks := actualSize / bs
-	if actualSize%bs > 0 {
+	return PlaintextSize(i.FileInfo.Size(), i.blockSize, i.overhead)
+}
+
+/*
+NewFileInfo wraps the FileInfo of a backing file to report the plaintext
+size. Directories and other non-regular files keep their raw size.
+*/
+func NewFileInfo(info os.FileInfo, blockSize int64, overhead int) os.FileInfo {
+	if info == nil || !info.Mode().IsRegular() {
+		return info
+	}
+	return &fileinfo{info, blockSize, overhead}
+}
+
+/*
+PlaintextSize calculates the size of the data stored in a backing file of
+the given size, removing the overhead of each block.
+*/
+func PlaintextSize(size int64, blockSize int64, overhead int) int64 {
+	bs := blockSize + int64(overhead)
+	numBlocks := size / bs
+	if size%bs > 0 {
 		numBlocks++
 	}
-	return actualSize - numBlocks*int64(i.overhead)
+	return size - numBlocks*int64(overhead)
 }
 
 func (w *transformBlockWriter) Write(p []byte) (n int, err error) {
@@ -83,10 +102,11 @@ func (w *transformBlockReader) Read(p []byte) (n int, err error) {
 	}
 	tr, n, trerr := transform.Bytes(w.Transformer, b[:m])
 	copy(p, tr)
-	if err != nil {
-		return len(tr), err
+	// Decoding errors of the last block take precedence over EOF
+	if trerr != nil {
+		return len(tr), trerr
 	}
-	return len(tr), trerr
+	return len(tr), err
 }
 
 /*
@@ -141,12 +161,17 @@ func (f *file) Name() string {
 }
 
 func (f *file) Close() error {
-	syncErr := f.Sync()
+	var syncErr error
+	if !f.readOnly {
+		syncErr = f.Sync()
+	}
 	closeErr := f.backing.Close()
 	return combineErrors(syncErr, closeErr)
 }
 
+// ReadAt does not change the offset of the file
 func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	defer f.restoreIndex(f.index)
 	_, err := f.rws.Seek(off, io.SeekStart)
 	if err != nil {
 		return 0, err
@@ -154,7 +179,18 @@ func (f *file) ReadAt(p []byte, off int64) (int, error) {
 	return f.rws.Read(p)
 }
 
+func (f *file) Write(p []byte) (int, error) {
+	if f.readOnly {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.EBADF}
+	}
+	return f.rws.Write(p)
+}
+
 func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	if f.readOnly {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.EBADF}
+	}
+	defer f.restoreIndex(f.index)
 	_, err := f.rws.Seek(off, io.SeekStart)
 	if err != nil {
 		return 0, err
@@ -162,12 +198,20 @@ func (f *file) WriteAt(p []byte, off int64) (int, error) {
 	return f.rws.Write(p)
 }
 
+func (f *file) restoreIndex(index int64) {
+	f.index = index
+}
+
 func (f *file) WriteString(s string) (ret int, err error) {
 	return f.Write([]byte(s))
 }
 
 func (f *file) Readdir(count int) ([]os.FileInfo, error) {
-	return f.backing.Readdir(count)
+	infos, err := f.backing.Readdir(count)
+	for i, info := range infos {
+		infos[i] = NewFileInfo(info, f.blockSize, f.blockOverhead)
+	}
+	return infos, err
 }
 
 func (f *file) Readdirnames(n int) ([]string, error) {
@@ -176,10 +220,7 @@ func (f *file) Readdirnames(n int) ([]string, error) {
 
 func (f *file) Stat() (os.FileInfo, error) {
 	info, err := f.backing.Stat()
-	if info != nil {
-		info = &fileinfo{info, f.blockSize, f.blockOverhead}
-	}
-	return info, err
+	return NewFileInfo(info, f.blockSize, f.blockOverhead), err
 }
 
 func (f *file) Sync() error {
@@ -190,10 +231,41 @@ func (f *file) Read(p []byte) (n int, err error) {
 	return f.rws.Read(p)
 }
 
+/*
+Truncate changes the size of the file. Growing files are filled with zero
+blocks, when shrinking, the last remaining block is rewritten. The offset
+of the file is not changed.
+*/
 func (f *file) Truncate(size int64) error {
-	// Calculate size to take overhead into account
-	// Rewrite last block
-	return fmt.Errorf("Truncating not implemented yet")
+	if f.readOnly {
+		return &os.PathError{Op: "truncate", Path: f.Name(), Err: syscall.EBADF}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.Name(), Err: syscall.EINVAL}
+	}
+	defer f.restoreIndex(f.index)
+	defer f.resetCurrentBlock()
+	end, err := f.rws.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size > end {
+		return f.fill(size)
+	}
+	blockIdx, blockOffset := size/f.blockSize, size%f.blockSize
+	blockStart := blockIdx * (f.blockSize + int64(f.blockOverhead))
+	if blockOffset == 0 {
+		return f.backing.Truncate(blockStart)
+	}
+	f.index = size
+	if err := f.loadBlock(); err != nil {
+		return err
+	}
+	f.currentBlock = f.currentBlock[:blockOffset]
+	if err := f.backing.Truncate(blockStart); err != nil {
+		return err
+	}
+	return f.flushCurrentBlock()
 }
 
 func (f *file) Seek(offset int64, whence int) (int64, error) {
@@ -208,7 +280,7 @@ func combineErrors(errs ...error) error {
 		}
 	}
 	if len(errstrings) > 0 {
-		return fmt.Errorf(strings.Join(errstrings, "\n"))
+		return errors.New(strings.Join(errstrings, "\n"))
 	}
 	return nil
 }
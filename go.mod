@@ -1,8 +1,11 @@
 module github.com/tobiash/go-transformfile
 
+go 1.21
+
 require (
-	github.com/pkg/errors v0.8.0
-	github.com/spf13/afero v1.1.2
-	golang.org/x/crypto v0.0.0-20181015023909-0c41d7ab0a0e
+	github.com/pkg/errors v0.8.1
+	github.com/spf13/afero v1.3.0
+	golang.org/x/crypto v0.0.0-20190820162420-60c769a6c586
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d
 	golang.org/x/text v0.3.0
 )
@@ -0,0 +1,500 @@
+package transformfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"golang.org/x/text/transform"
+)
+
+/*
+LogFile is a transformed file using a log-structured block layout.
+Instead of overwriting blocks in place, every write appends a new version
+of the affected block to the end of the backing file. A block map tracks
+the record holding the current version of each logical block.
+*/
+type LogFile interface {
+	File
+	// Compact rewrites the backing file so that it only contains the
+	// current version of each block, dropping all stale versions. The
+	// compacted log is written to a sibling file in fs, the filesystem
+	// holding the backing file, which is then renamed over the backing
+	// file, so a crash during compaction leaves the original log intact.
+	Compact(fs afero.Fs) error
+}
+
+// LogCompactSuffix is appended to the name of a log while it is compacted
+const LogCompactSuffix = ".compact"
+
+const (
+	logRecordMagic      = 0x54524c31 // "TRL1"
+	logRecordHeaderSize = 28
+	// Block index of records that only carry a new file size
+	logSizeRecord = -1
+)
+
+/*
+Record layout in the backing file:
+
+	magic    uint32
+	block    int64   logical block index or logSizeRecord
+	size     int64   plaintext file size after this record
+	length   uint32  length of the encoded block
+	checksum uint32  CRC32 (IEEE) of the encoded block
+	data     [length]byte
+*/
+type logRecord struct {
+	block    int64
+	size     int64
+	length   uint32
+	checksum uint32
+}
+
+type logFile struct {
+	blockSize        int64
+	blockOverhead    int
+	backing          File
+	readOnly         bool
+	readTransformer  transform.Transformer
+	writeTransformer transform.Transformer
+	blocks           map[int64]int64 // Logical block -> offset of its current record
+	size             int64
+	end              int64 // End of the valid part of the log
+	index            int64
+	// Set when the backing file was lost during compaction
+	failed error
+}
+
+type logFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *logFileInfo) Size() int64 {
+	return i.size
+}
+
+/*
+NewLog creates a file wrapper around a backing file using a log-structured
+block layout. The backing file is scanned to rebuild the block map. A torn
+record at the end of the log, as left behind by a crash during a write, is
+ignored and overwritten by the next write. Every block is passed through
+the transformers as a whole, so the transformers may buffer internally.
+*/
+func NewLog(
+	blockSize int64,
+	blockOverhead int,
+	backing File,
+	readOnly bool,
+	readTransformer transform.Transformer,
+	writeTransformer transform.Transformer,
+) (LogFile, error) {
+	f := &logFile{
+		blockSize:        blockSize,
+		blockOverhead:    blockOverhead,
+		backing:          backing,
+		readOnly:         readOnly,
+		readTransformer:  readTransformer,
+		writeTransformer: writeTransformer,
+		blocks:           make(map[int64]int64),
+	}
+	if err := f.scan(); err != nil {
+		return nil, errors.Wrap(err, "Error scanning log")
+	}
+	if !readOnly {
+		// Drop a torn record left behind by an interrupted write
+		info, err := backing.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() > f.end {
+			if err := backing.Truncate(f.end); err != nil {
+				return nil, errors.Wrap(err, "Error truncating torn record")
+			}
+		}
+	}
+	return f, nil
+}
+
+// Rebuilds the block map from the records in the backing file
+func (f *logFile) scan() error {
+	var off int64
+	for {
+		rec, err := f.readRecordHeader(off)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errInvalidRecord {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rec.block != logSizeRecord {
+			data := make([]byte, rec.length)
+			_, err = f.backing.ReadAt(data, off+logRecordHeaderSize)
+			if err == io.EOF || (err == nil && crc32.ChecksumIEEE(data) != rec.checksum) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			f.blocks[rec.block] = off
+		}
+		f.applySize(rec.size)
+		off += logRecordHeaderSize + int64(rec.length)
+	}
+	f.end = off
+	return nil
+}
+
+var errInvalidRecord = fmt.Errorf("invalid log record")
+
+func (f *logFile) readRecordHeader(off int64) (*logRecord, error) {
+	var h [logRecordHeaderSize]byte
+	n, err := f.backing.ReadAt(h[:], off)
+	if n < len(h) {
+		if err == nil || err == io.EOF {
+			if n == 0 {
+				return nil, io.EOF
+			}
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(h[0:]) != logRecordMagic {
+		return nil, errInvalidRecord
+	}
+	rec := &logRecord{
+		block:    int64(binary.BigEndian.Uint64(h[4:])),
+		size:     int64(binary.BigEndian.Uint64(h[12:])),
+		length:   binary.BigEndian.Uint32(h[20:]),
+		checksum: binary.BigEndian.Uint32(h[24:]),
+	}
+	if rec.size < 0 || rec.block < logSizeRecord || int64(rec.length) > f.blockSize+int64(f.blockOverhead) {
+		return nil, errInvalidRecord
+	}
+	return rec, nil
+}
+
+// Updates the file size, forgetting blocks that are no longer part of the file
+func (f *logFile) applySize(size int64) {
+	if size < f.size {
+		numBlocks := size / f.blockSize
+		if size%f.blockSize > 0 {
+			numBlocks++
+		}
+		for idx := range f.blocks {
+			if idx >= numBlocks {
+				delete(f.blocks, idx)
+			}
+		}
+	}
+	f.size = size
+}
+
+// Appends a record to the end of the log
+func (f *logFile) appendRecord(block int64, size int64, encoded []byte) error {
+	rec := make([]byte, logRecordHeaderSize+len(encoded))
+	binary.BigEndian.PutUint32(rec[0:], logRecordMagic)
+	binary.BigEndian.PutUint64(rec[4:], uint64(block))
+	binary.BigEndian.PutUint64(rec[12:], uint64(size))
+	binary.BigEndian.PutUint32(rec[20:], uint32(len(encoded)))
+	binary.BigEndian.PutUint32(rec[24:], crc32.ChecksumIEEE(encoded))
+	copy(rec[logRecordHeaderSize:], encoded)
+	written, err := f.backing.WriteAt(rec, f.end)
+	if err != nil {
+		return err
+	}
+	if written != len(rec) {
+		return fmt.Errorf("Could not write record, %d bytes written, record size was %d", written, len(rec))
+	}
+	if block != logSizeRecord {
+		f.blocks[block] = f.end
+	}
+	f.end += int64(len(rec))
+	f.applySize(size)
+	return nil
+}
+
+// Reads the encoded data of the record at the given offset
+func (f *logFile) readEncoded(off int64) ([]byte, error) {
+	rec, err := f.readRecordHeader(off)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, rec.length)
+	_, err = f.backing.ReadAt(data, off+logRecordHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != rec.checksum {
+		return nil, fmt.Errorf("Checksum mismatch in record at offset %d", off)
+	}
+	return data, nil
+}
+
+// Loads the plaintext of the given block. Blocks that were never written
+// read as zeros up to the file size.
+func (f *logFile) loadBlock(block int64) ([]byte, error) {
+	length := min(f.blockSize, f.size-block*f.blockSize)
+	if length <= 0 {
+		return nil, nil
+	}
+	off, ok := f.blocks[block]
+	if !ok {
+		return make([]byte, length), nil
+	}
+	encoded, err := f.readEncoded(off)
+	if err != nil {
+		return nil, &BlockError{block, err}
+	}
+	data, _, err := transform.Bytes(f.readTransformer, encoded)
+	if err != nil {
+		return nil, &BlockError{block, err}
+	}
+	if int64(len(data)) < length {
+		data = append(data, make([]byte, length-int64(len(data)))...)
+	}
+	return data[:length], nil
+}
+
+func (f *logFile) writeBlock(block int64, data []byte, size int64) error {
+	encoded, _, err := transform.Bytes(f.writeTransformer, data)
+	if err != nil {
+		return errors.Wrapf(err, "Error encoding block %d", block)
+	}
+	return f.appendRecord(block, size, encoded)
+}
+
+func (f *logFile) Read(p []byte) (n int, err error) {
+	if f.failed != nil {
+		return 0, f.failed
+	}
+	for len(p)-n > 0 && f.index < f.size {
+		block, blockOffset := f.index/f.blockSize, f.index%f.blockSize
+		data, err := f.loadBlock(block)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], data[blockOffset:])
+		n += copied
+		f.index += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *logFile) Write(p []byte) (n int, err error) {
+	if f.readOnly {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.EBADF}
+	}
+	if f.failed != nil {
+		return 0, f.failed
+	}
+	for len(p)-n > 0 {
+		block, blockOffset := f.index/f.blockSize, f.index%f.blockSize
+		data, err := f.loadBlock(block)
+		if err != nil {
+			return n, err
+		}
+		data, copied := mergeBlocks(data, p[n:], blockOffset, f.blockSize)
+		size := max(f.size, block*f.blockSize+int64(len(data)))
+		if err := f.writeBlock(block, data, size); err != nil {
+			return n, errors.Wrap(err, "Error writing block")
+		}
+		n += copied
+		f.index += int64(copied)
+	}
+	return n, nil
+}
+
+func (f *logFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.index
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return f.index, errUnsupportedSeekMode
+	}
+	if offset < 0 {
+		return f.index, ErrInvalidSeek
+	}
+	f.index = offset
+	return f.index, nil
+}
+
+// ReadAt does not change the offset of the file
+func (f *logFile) ReadAt(p []byte, off int64) (int, error) {
+	defer f.restoreIndex(f.index)
+	_, err := f.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return f.Read(p)
+}
+
+func (f *logFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.readOnly {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.EBADF}
+	}
+	defer f.restoreIndex(f.index)
+	_, err := f.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return f.Write(p)
+}
+
+func (f *logFile) restoreIndex(index int64) {
+	f.index = index
+}
+
+func (f *logFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *logFile) Truncate(size int64) error {
+	if f.readOnly {
+		return &os.PathError{Op: "truncate", Path: f.Name(), Err: syscall.EBADF}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.Name(), Err: syscall.EINVAL}
+	}
+	if f.failed != nil {
+		return f.failed
+	}
+	if size < f.size && size%f.blockSize > 0 {
+		// Rewrite the new last block, so growing the file later reads zeros
+		block := size / f.blockSize
+		data, err := f.loadBlock(block)
+		if err != nil {
+			return err
+		}
+		return f.writeBlock(block, data[:size%f.blockSize], size)
+	}
+	return f.appendRecord(logSizeRecord, size, nil)
+}
+
+func (f *logFile) Compact(fs afero.Fs) error {
+	if f.readOnly {
+		return &os.PathError{Op: "compact", Path: f.Name(), Err: syscall.EBADF}
+	}
+	if f.failed != nil {
+		return f.failed
+	}
+	name := f.backing.Name()
+	info, err := f.backing.Stat()
+	if err != nil {
+		return err
+	}
+	var live []int64
+	for block := range f.blocks {
+		live = append(live, block)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i] < live[j] })
+
+	tmpName := name + LogCompactSuffix
+	tmp, err := fs.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return errors.Wrap(err, "Error creating compacted log")
+	}
+	compacted := &logFile{
+		blockSize:     f.blockSize,
+		blockOverhead: f.blockOverhead,
+		backing:       tmp,
+		blocks:        make(map[int64]int64),
+	}
+	if err := f.writeCompacted(compacted, live); err != nil {
+		tmp.Close()
+		fs.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		fs.Remove(tmpName)
+		return err
+	}
+	// The original log stays intact until the compacted one replaces it
+	if err := fs.Rename(tmpName, name); err != nil {
+		fs.Remove(tmpName)
+		return errors.Wrap(err, "Error replacing log")
+	}
+	backing, err := fs.OpenFile(name, os.O_RDWR, 0)
+	f.backing.Close()
+	if err != nil {
+		// The old handle refers to the replaced log, it must not be used
+		// any more
+		f.failed = errors.Wrap(err, "Error reopening compacted log")
+		return f.failed
+	}
+	f.backing = backing
+	f.blocks = compacted.blocks
+	f.end = compacted.end
+	return nil
+}
+
+// Copies the current records of the given blocks to the compacted log
+func (f *logFile) writeCompacted(compacted *logFile, live []int64) error {
+	for _, block := range live {
+		data, err := f.readEncoded(f.blocks[block])
+		if err != nil {
+			return errors.Wrapf(err, "Error reading block %d", block)
+		}
+		if err := compacted.appendRecord(block, f.size, data); err != nil {
+			return errors.Wrap(err, "Error writing compacted block")
+		}
+	}
+	if len(live) == 0 {
+		if err := compacted.appendRecord(logSizeRecord, f.size, nil); err != nil {
+			return errors.Wrap(err, "Error writing compacted log")
+		}
+	}
+	return compacted.backing.Sync()
+}
+
+func (f *logFile) Name() string {
+	return f.backing.Name()
+}
+
+func (f *logFile) Close() error {
+	if f.failed != nil {
+		return f.failed
+	}
+	var syncErr error
+	if !f.readOnly {
+		syncErr = f.Sync()
+	}
+	closeErr := f.backing.Close()
+	return combineErrors(syncErr, closeErr)
+}
+
+func (f *logFile) Readdir(count int) ([]os.FileInfo, error) {
+	return f.backing.Readdir(count)
+}
+
+func (f *logFile) Readdirnames(n int) ([]string, error) {
+	return f.backing.Readdirnames(n)
+}
+
+func (f *logFile) Stat() (os.FileInfo, error) {
+	info, err := f.backing.Stat()
+	if info != nil {
+		info = &logFileInfo{info, f.size}
+	}
+	return info, err
+}
+
+func (f *logFile) Sync() error {
+	if f.failed != nil {
+		return f.failed
+	}
+	return f.backing.Sync()
+}
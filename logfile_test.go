@@ -0,0 +1,260 @@
+package transformfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs/nacltr"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/text/transform"
+)
+
+var logKey = [32]byte{1, 2, 3}
+
+func openLog(t *testing.T, fs afero.Fs, blockSize int64) LogFile {
+	f, err := fs.OpenFile("log", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLog(
+		blockSize,
+		nacltr.NONCE_SIZE+secretbox.Overhead,
+		f,
+		false,
+		nacltr.NewDecryptTransformer(&logKey, blockSize),
+		nacltr.NewEncryptTransformer(&logKey, blockSize),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func readAll(t *testing.T, f File) string {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(d)
+}
+
+func TestLogWriteReopen(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	l := openLog(t, fs, 4)
+	l.WriteString("Hello, World!")
+	l.WriteAt([]byte("J"), 0)
+	l.WriteAt([]byte("w"), 7)
+	if d := readAll(t, l); d != "Jello, world!" {
+		t.Errorf("Unexpected contents %q", d)
+	}
+	l.Close()
+
+	l = openLog(t, fs, 4)
+	defer l.Close()
+	if d := readAll(t, l); d != "Jello, world!" {
+		t.Errorf("Unexpected contents after reopen %q", d)
+	}
+	info, err := l.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 13 {
+		t.Errorf("Unexpected size %d, expected 13", info.Size())
+	}
+}
+
+func TestLogTornRecord(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	l := openLog(t, fs, 4)
+	l.WriteString("abcdefgh")
+	l.Close()
+
+	// Simulate a crash in the middle of appending a record
+	raw, _ := afero.ReadFile(fs, "log")
+	torn := append(raw, raw[:logRecordHeaderSize+10]...)
+	afero.WriteFile(fs, "log", torn, 0644)
+
+	l = openLog(t, fs, 4)
+	if d := readAll(t, l); d != "abcdefgh" {
+		t.Errorf("Unexpected contents %q", d)
+	}
+	l.WriteAt([]byte("X"), 3)
+	l.Close()
+	l = openLog(t, fs, 4)
+	defer l.Close()
+	if d := readAll(t, l); d != "abcXefgh" {
+		t.Errorf("Unexpected contents after write %q", d)
+	}
+}
+
+func TestLogTruncate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	l := openLog(t, fs, 4)
+	defer l.Close()
+	l.WriteString("abcdefghij")
+	if err := l.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if d := readAll(t, l); d != "abcde" {
+		t.Errorf("Unexpected contents %q", d)
+	}
+	if err := l.Truncate(7); err != nil {
+		t.Fatal(err)
+	}
+	if d := readAll(t, l); d != "abcde\x00\x00" {
+		t.Errorf("Unexpected contents after growing %q", d)
+	}
+}
+
+func TestLogCompact(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	l := openLog(t, fs, 4)
+	for i := 0; i < 10; i++ {
+		l.WriteAt([]byte("abcdefgh"), 0)
+	}
+	info, _ := fs.Stat("log")
+	before := info.Size()
+	if err := l.Compact(fs); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = fs.Stat("log")
+	if after := info.Size(); after >= before {
+		t.Errorf("Compaction did not shrink log: %d >= %d", after, before)
+	}
+	// The compacted log stays usable
+	l.WriteAt([]byte("X"), 1)
+	l.Close()
+
+	l = openLog(t, fs, 4)
+	defer l.Close()
+	if d := readAll(t, l); d != "aXcdefgh" {
+		t.Errorf("Unexpected contents after compaction %q", d)
+	}
+}
+
+// Fails all renames, like a crash before the compacted log replaces the original
+type noRenameFs struct {
+	afero.Fs
+}
+
+func (fs noRenameFs) Rename(oldname, newname string) error {
+	return fmt.Errorf("interrupted")
+}
+
+func TestLogCompactInterrupted(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	l := openLog(t, fs, 4)
+	for i := 0; i < 3; i++ {
+		l.WriteAt([]byte("abcdefgh"), 0)
+	}
+	raw, _ := afero.ReadFile(fs, "log")
+	if err := l.Compact(noRenameFs{fs}); err == nil {
+		t.Fatalf("Compaction should have failed")
+	}
+	if after, _ := afero.ReadFile(fs, "log"); !bytes.Equal(after, raw) {
+		t.Errorf("Interrupted compaction changed the log")
+	}
+	if ok, _ := afero.Exists(fs, "log"+LogCompactSuffix); ok {
+		t.Errorf("Compacted log was left behind")
+	}
+	l.Close()
+
+	l = openLog(t, fs, 4)
+	defer l.Close()
+	if d := readAll(t, l); d != "abcdefgh" {
+		t.Errorf("Unexpected contents after interrupted compaction %q", d)
+	}
+}
+
+func TestLogTransparent(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	f, _ := fs.OpenFile("log", os.O_CREATE|os.O_RDWR, 0644)
+	l, err := NewLog(8, 0, f, false, transform.Nop, transform.Nop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.WriteString(TestMessage)
+	l.Close()
+	raw, _ := afero.ReadFile(fs, "log")
+	if !bytes.Contains(raw, []byte("Hello, W")) {
+		t.Errorf("Expected plain block in log %v", raw)
+	}
+}
+
+func TestLogAtKeepsOffset(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	l := openLog(t, fs, 4)
+	defer l.Close()
+	l.WriteString("abcdefgh")
+	l.Seek(2, io.SeekStart)
+	l.WriteAt([]byte("XY"), 5)
+	buf := make([]byte, 3)
+	l.ReadAt(buf, 4)
+	if string(buf) != "eXY" {
+		t.Errorf("Unexpected ReadAt result %q", buf)
+	}
+	if pos, _ := l.Seek(0, io.SeekCurrent); pos != 2 {
+		t.Errorf("ReadAt/WriteAt moved the offset to %d", pos)
+	}
+}
+
+func TestLogReadOnlyWrite(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	l := openLog(t, fs, 4)
+	l.WriteString("abcd")
+	l.Close()
+
+	f, _ := fs.Open("log")
+	l, err := NewLog(4, nacltr.NONCE_SIZE+secretbox.Overhead, f, true,
+		nacltr.NewDecryptTransformer(&logKey, 4), nacltr.NewEncryptTransformer(&logKey, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, err = l.Write([]byte("x"))
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EBADF {
+		t.Errorf("Expected EBADF writing read-only log, got %v", err)
+	}
+}
+
+// Fails opening existing files, like a log that cannot be reopened
+type noReopenFs struct {
+	afero.Fs
+}
+
+func (fs noReopenFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&os.O_CREATE == 0 {
+		return nil, fmt.Errorf("unavailable")
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func TestLogCompactReopenFails(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	l := openLog(t, fs, 4)
+	l.WriteString("abcdefgh")
+	if err := l.Compact(noReopenFs{fs}); err == nil {
+		t.Fatalf("Compaction should have failed")
+	}
+	if _, err := l.Write([]byte("x")); err == nil {
+		t.Errorf("Write succeeded after the log was lost")
+	}
+	if err := l.Close(); err == nil {
+		t.Errorf("Close succeeded after the log was lost")
+	}
+
+	l = openLog(t, fs, 4)
+	defer l.Close()
+	if d := readAll(t, l); d != "abcdefgh" {
+		t.Errorf("Unexpected contents after compaction %q", d)
+	}
+}
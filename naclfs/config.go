@@ -0,0 +1,159 @@
+package naclfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs/nacltr"
+	"github.com/tobiash/go-transformfile/trfs"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Codec is the name of the naclfs codec recorded in the filesystem config
+const Codec = "nacl-secretbox"
+
+// DefaultBlockSize is used by Init if no block size is given
+const DefaultBlockSize = 64 * 1024
+
+var (
+	/* ErrWrongKey is returned when opening a tree with a key it was not created with */
+	ErrWrongKey = fmt.Errorf("key does not match filesystem")
+
+	errNeedsKeyring = fmt.Errorf("filesystem has a keyring, it has to be opened with FromKeyring")
+)
+
+/*
+Options for a new naclfs tree
+*/
+type Options struct {
+	BlockSize int64
+	// NameEncryption enables encrypted file names
+	NameEncryption bool
+	// MaxNameLength of encrypted names, see trfs.WithMaxNameLength
+	MaxNameLength int
+}
+
+/*
+KeyProvider supplies the key for a tree, given its config
+*/
+type KeyProvider interface {
+	Key(cfg *trfs.Config) (*[32]byte, error)
+}
+
+/*
+KeyProviderFunc adapts a function to a KeyProvider
+*/
+type KeyProviderFunc func(cfg *trfs.Config) (*[32]byte, error)
+
+func (f KeyProviderFunc) Key(cfg *trfs.Config) (*[32]byte, error) {
+	return f(cfg)
+}
+
+/*
+StaticKey provides a fixed key
+*/
+func StaticKey(key *[32]byte) KeyProvider {
+	return KeyProviderFunc(func(*trfs.Config) (*[32]byte, error) {
+		return key, nil
+	})
+}
+
+func keyVerifier(key *[32]byte) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("naclfs key verifier"))
+	return mac.Sum(nil)
+}
+
+/*
+Init initialises a new naclfs tree on the backing filesystem, recording
+its parameters in a config file at the root. opts may be nil.
+*/
+func Init(backing afero.Fs, key *[32]byte, opts *Options) (afero.Fs, error) {
+	cfg := newConfig(key, opts)
+	if err := trfs.WriteConfig(backing, cfg); err != nil {
+		return nil, err
+	}
+	return fromConfig(backing, cfg, key), nil
+}
+
+func newConfig(key *[32]byte, opts *Options) *trfs.Config {
+	if opts == nil {
+		opts = new(Options)
+	}
+	cfg := &trfs.Config{
+		Version:     trfs.ConfigVersion,
+		BlockSize:   opts.BlockSize,
+		Overhead:    nacltr.NONCE_SIZE + secretbox.Overhead,
+		Codec:       Codec,
+		KeyVerifier: keyVerifier(key),
+	}
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = DefaultBlockSize
+	}
+	if opts.NameEncryption {
+		cfg.MaxNameLength = opts.MaxNameLength
+		if cfg.MaxNameLength == 0 {
+			cfg.MaxNameLength = trfs.DefaultMaxNameLength
+		}
+	}
+	return cfg
+}
+
+/*
+Open opens an existing naclfs tree using the parameters recorded in its
+config. The key is checked against the config before it is used. Trees
+created with InitKeyring are opened with the keyring given by FromKeyring.
+*/
+func Open(backing afero.Fs, keys KeyProvider, opts ...trfs.Option) (afero.Fs, error) {
+	cfg, err := trfs.ReadConfig(backing)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Codec == KeyringCodec {
+		return openKeyring(backing, cfg, keys, opts...)
+	}
+	if cfg.Codec != Codec {
+		return nil, fmt.Errorf("Unsupported codec %q", cfg.Codec)
+	}
+	if cfg.Overhead != nacltr.NONCE_SIZE+secretbox.Overhead {
+		return nil, fmt.Errorf("Unexpected block overhead %d", cfg.Overhead)
+	}
+	key, err := keys.Key(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(cfg.KeyVerifier, keyVerifier(key)) {
+		return nil, ErrWrongKey
+	}
+	return fromConfig(backing, cfg, key, opts...), nil
+}
+
+// Opens a tree created with InitKeyring
+func openKeyring(backing afero.Fs, cfg *trfs.Config, keys KeyProvider, opts ...trfs.Option) (afero.Fs, error) {
+	ring, ok := keys.(keyringProvider)
+	if !ok {
+		return nil, errNeedsKeyring
+	}
+	if cfg.Overhead != keyringOverhead {
+		return nil, fmt.Errorf("Unexpected block overhead %d", cfg.Overhead)
+	}
+	if cfg.MaxNameLength > 0 {
+		return nil, errKeyringNames
+	}
+	if err := checkKeyring(cfg, ring.keys); err != nil {
+		return nil, err
+	}
+	return NewWithKeyring(cfg.BlockSize, ring.keys, backing, opts...), nil
+}
+
+func fromConfig(backing afero.Fs, cfg *trfs.Config, key *[32]byte, opts ...trfs.Option) afero.Fs {
+	if cfg.MaxNameLength > 0 {
+		opts = append([]trfs.Option{
+			WithNameEncryption(key),
+			trfs.WithMaxNameLength(cfg.MaxNameLength),
+		}, opts...)
+	}
+	return New(cfg.BlockSize, key, backing, opts...)
+}
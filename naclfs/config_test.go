@@ -0,0 +1,42 @@
+package naclfs_test
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func TestInitOpen(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs, err := naclfs.Init(backing, Key("config"), &naclfs.Options{BlockSize: 100, NameEncryption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/file", []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := naclfs.Init(backing, Key("config"), nil); err != trfs.ErrConfigExists {
+		t.Errorf("Expected second init to fail, got %v", err)
+	}
+
+	if _, err := naclfs.Open(backing, naclfs.StaticKey(Key("wrong"))); err != naclfs.ErrWrongKey {
+		t.Errorf("Expected wrong key to be detected, got %v", err)
+	}
+	fs, err = naclfs.Open(backing, naclfs.StaticKey(Key("config")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(fs, "/file"); err != nil || string(d) != "Hello, World!" {
+		t.Errorf("Unexpected contents %q, %v", d, err)
+	}
+	names, _ := afero.ReadDir(fs, "/")
+	if len(names) != 1 {
+		t.Errorf("Config should be hidden, got %d entries", len(names))
+	}
+
+	if _, err := naclfs.Open(afero.NewMemMapFs(), naclfs.StaticKey(Key("config"))); err != trfs.ErrNoConfig {
+		t.Errorf("Expected missing config error, got %v", err)
+	}
+}
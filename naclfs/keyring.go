@@ -0,0 +1,252 @@
+package naclfs
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"sync"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs/nacltr"
+	"github.com/tobiash/go-transformfile/trfs"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/text/transform"
+)
+
+const (
+	// KeyringCodec is the name of the naclfs codec with key IDs recorded in the filesystem config
+	KeyringCodec = "nacl-secretbox-keyring"
+	// KEYRING_FS_NAME is the name of filesystems created by NewWithKeyring
+	KEYRING_FS_NAME = "naclfs-keyring"
+	keyringOverhead = nacltr.KEY_ID_SIZE + nacltr.NONCE_SIZE + secretbox.Overhead
+)
+
+var errKeyringNames = fmt.Errorf("trees with a keyring do not support name encryption")
+
+/*
+Keyring holds the keys of a tree by ID. Blocks are encrypted with the
+active key and record its ID, so blocks written before a rotation stay
+readable as long as their key is in the keyring. A Keyring is safe for
+concurrent use.
+*/
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[uint32]*[32]byte
+	active uint32
+}
+
+// NewKeyring returns a keyring with the given key as the active one
+func NewKeyring(id uint32, key *[32]byte) *Keyring {
+	return &Keyring{keys: map[uint32]*[32]byte{id: key}, active: id}
+}
+
+/*
+Add adds a key to the keyring, without activating it. Fails if another key
+with the same ID is in the keyring.
+*/
+func (k *Keyring) Add(id uint32, key *[32]byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if old, ok := k.keys[id]; ok && *old != *key {
+		return fmt.Errorf("Keyring has another key with ID %d", id)
+	}
+	k.keys[id] = key
+	return nil
+}
+
+/*
+SetActive makes the key with the given ID the one new blocks are encrypted
+with, including blocks of files that are already open
+*/
+func (k *Keyring) SetActive(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("Keyring has no key with ID %d", id)
+	}
+	k.active = id
+	return nil
+}
+
+// Active returns the ID of the active key
+func (k *Keyring) Active() uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// Key returns the key with the given ID, nil if it is not in the keyring
+func (k *Keyring) Key(id uint32) *[32]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[id]
+}
+
+func (k *Keyring) activeKey() (uint32, *[32]byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active, k.keys[k.active]
+}
+
+// Returns the verifiers of all keys by ID
+func (k *Keyring) verifiers() map[uint32][]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	verifiers := make(map[uint32][]byte, len(k.keys))
+	for id, key := range k.keys {
+		verifiers[id] = keyVerifier(key)
+	}
+	return verifiers
+}
+
+func (k *Keyring) readTransformer() transform.Transformer {
+	return nacltr.NewKeyringDecryptTransformer(k.Key)
+}
+
+func (k *Keyring) writeTransformer() transform.Transformer {
+	return nacltr.NewKeyringEncryptTransformer(k.activeKey)
+}
+
+/*
+NewWithKeyring creates a naclfs like New, whose blocks record the ID of the
+key they are encrypted with. Blocks are read with the key of their ID and
+written with the active key of the keyring. Names are not affected by the
+keyring, WithNameEncryption still takes a single key.
+*/
+func NewWithKeyring(blockSize int64, keys *Keyring, backing afero.Fs, opts ...trfs.Option) afero.Fs {
+	readTr := func() transform.Transformer {
+		return keys.readTransformer()
+	}
+	writeTr := func() transform.Transformer {
+		return keys.writeTransformer()
+	}
+
+	return trfs.NewTransformFileFs(
+		blockSize,
+		keyringOverhead,
+		KEYRING_FS_NAME,
+		backing,
+		readTr, writeTr,
+		opts...,
+	)
+}
+
+/*
+InitKeyring initialises a new naclfs tree like Init, whose blocks record the
+ID of their key like those of NewWithKeyring. The config records a verifier
+for each key of the keyring. The tree is opened with Open and FromKeyring.
+Name encryption is not supported.
+*/
+func InitKeyring(backing afero.Fs, keys *Keyring, opts *Options) (afero.Fs, error) {
+	if opts != nil && opts.NameEncryption {
+		return nil, errKeyringNames
+	}
+	_, key := keys.activeKey()
+	cfg := newConfig(key, opts)
+	cfg.Codec, cfg.Overhead = KeyringCodec, keyringOverhead
+	cfg.KeyVerifier, cfg.KeyVerifiers = nil, keys.verifiers()
+	if err := trfs.WriteConfig(backing, cfg); err != nil {
+		return nil, err
+	}
+	return NewWithKeyring(cfg.BlockSize, keys, backing), nil
+}
+
+/*
+UpdateKeyring records the keys added to a keyring in the config of a tree
+created with InitKeyring, so Open accepts the keyring. The keyring has to
+hold at least one key recorded before and all of them have to match,
+otherwise ErrWrongKey is returned.
+*/
+func UpdateKeyring(backing afero.Fs, keys *Keyring) error {
+	cfg, err := trfs.ReadConfig(backing)
+	if err != nil {
+		return err
+	}
+	if cfg.Codec != KeyringCodec {
+		return fmt.Errorf("Unsupported codec %q", cfg.Codec)
+	}
+	if cfg.KeyVerifiers == nil {
+		cfg.KeyVerifiers = make(map[uint32][]byte)
+	}
+	verified, changed := false, false
+	for id, v := range keys.verifiers() {
+		recorded, ok := cfg.KeyVerifiers[id]
+		if ok && !hmac.Equal(recorded, v) {
+			return ErrWrongKey
+		}
+		if ok {
+			verified = true
+		} else {
+			cfg.KeyVerifiers[id], changed = v, true
+		}
+	}
+	if !verified {
+		return ErrWrongKey
+	}
+	if !changed {
+		return nil
+	}
+	return trfs.ReplaceConfig(backing, cfg)
+}
+
+// Checks every key of the keyring against the verifiers in the config
+func checkKeyring(cfg *trfs.Config, keys *Keyring) error {
+	for id, v := range keys.verifiers() {
+		recorded, ok := cfg.KeyVerifiers[id]
+		if !ok {
+			return fmt.Errorf("Key %d of the keyring is not recorded in the config, see UpdateKeyring", id)
+		}
+		if !hmac.Equal(recorded, v) {
+			return ErrWrongKey
+		}
+	}
+	return nil
+}
+
+type keyringProvider struct {
+	keys *Keyring
+}
+
+func (p keyringProvider) Key(*trfs.Config) (*[32]byte, error) {
+	_, key := p.keys.activeKey()
+	return key, nil
+}
+
+/*
+FromKeyring provides the keys of a keyring to Open. Trees created with
+InitKeyring are opened with the whole keyring, blocks with keys missing
+from it fail to decrypt. Other trees are opened with the active key.
+*/
+func FromKeyring(keys *Keyring) KeyProvider {
+	return keyringProvider{keys}
+}
+
+/*
+NewKeyringCodec returns the naclfs encryption with key IDs as a codec, to
+be chained with other codecs in trfs.NewChainFs
+*/
+func NewKeyringCodec(keys *Keyring) trfs.Codec {
+	return trfs.Codec{
+		Name:     KeyringCodec,
+		Overhead: keyringOverhead,
+		NewReadTransformer: func(int64) transform.Transformer {
+			return keys.readTransformer()
+		},
+		NewWriteTransformer: func(int64) transform.Transformer {
+			return keys.writeTransformer()
+		},
+	}
+}
+
+/*
+Reencrypt moves the files of a tree to the active key of the keyring fs
+was created with by NewWithKeyring or opened with by FromKeyring. Files
+are converted by trfs.Reencode, so an interrupted run continues where it
+stopped when Reencrypt is called again. Modification times are kept,
+snapshots are removed. progress may be nil.
+
+Reencrypt works offline only: no other filesystem or handle, including
+handles opened through fs, may use the tree until it returns.
+*/
+func Reencrypt(fs afero.Fs, progress func(trfs.Progress)) error {
+	return trfs.Reencode(fs, fs, progress)
+}
@@ -0,0 +1,167 @@
+package naclfs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/naclfs/nacltr"
+	"github.com/tobiash/go-transformfile/trfs"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const ringBlockSize = 16
+
+// Returns the key IDs of the blocks of a backing file
+func keyIDs(t *testing.T, backing afero.Fs, name string) []uint32 {
+	data, err := afero.ReadFile(backing, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint32
+	size := ringBlockSize + nacltr.KEY_ID_SIZE + nacltr.NONCE_SIZE + secretbox.Overhead
+	for off := 0; off < len(data); off += size {
+		ids = append(ids, binary.BigEndian.Uint32(data[off:]))
+	}
+	return ids
+}
+
+func TestKeyring(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	ring := naclfs.NewKeyring(1, Key("first"))
+	fs := naclfs.NewWithKeyring(ringBlockSize, ring, backing)
+	old := bytes.Repeat([]byte("written with the first key "), 3)
+	if err := afero.WriteFile(fs, "/old.txt", old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := fs.Chtimes("/old.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ring.SetActive(2); err == nil {
+		t.Errorf("Activating an unknown key should fail")
+	}
+	if err := ring.Add(2, Key("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Add(1, Key("other")); err == nil {
+		t.Errorf("Adding another key with a used ID should fail")
+	}
+	if err := ring.SetActive(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/dir/new.txt", []byte("second key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string][]uint32{"/old.txt": {1, 1, 1, 1, 1, 1}, "/dir/new.txt": {2}} {
+		if ids := keyIDs(t, backing, name); !equalIDs(ids, want) {
+			t.Errorf("Expected key IDs %v for %s, got %v", want, name, ids)
+		}
+	}
+	if data, err := afero.ReadFile(fs, "/old.txt"); err != nil || !bytes.Equal(data, old) {
+		t.Errorf("Reading after rotation failed: %q, %v", data, err)
+	}
+
+	var last trfs.Progress
+	if err := naclfs.Reencrypt(fs, func(p trfs.Progress) { last = p }); err != nil {
+		t.Fatal(err)
+	}
+	if last.Files != 2 || last.Files != last.TotalFiles || last.Bytes != last.TotalBytes {
+		t.Errorf("Unexpected progress %+v", last)
+	}
+	if ids := keyIDs(t, backing, "/old.txt"); !equalIDs(ids, []uint32{2, 2, 2, 2, 2, 2}) {
+		t.Errorf("Expected re-encrypted blocks to use key 2, got %v", ids)
+	}
+	if info, err := fs.Stat("/old.txt"); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("Modification time was not kept: %v, %v", info.ModTime(), err)
+	}
+
+	// The first key is no longer needed
+	fs = naclfs.NewWithKeyring(ringBlockSize, naclfs.NewKeyring(2, Key("second")), backing)
+	if data, err := afero.ReadFile(fs, "/old.txt"); err != nil || !bytes.Equal(data, old) {
+		t.Errorf("Reading with the second key only failed: %q, %v", data, err)
+	}
+	fs = naclfs.NewWithKeyring(ringBlockSize, naclfs.NewKeyring(1, Key("first")), backing)
+	if _, err := afero.ReadFile(fs, "/old.txt"); err == nil {
+		t.Errorf("Reading without the second key should fail")
+	}
+}
+
+func TestKeyringConfig(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	ring := naclfs.NewKeyring(1, Key("first"))
+	fs, err := naclfs.InitKeyring(backing, ring, &naclfs.Options{BlockSize: ringBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/file", []byte("written with the first key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := naclfs.Open(backing, naclfs.StaticKey(Key("first"))); err == nil {
+		t.Errorf("Opening a keyring tree without a keyring should fail")
+	}
+
+	if _, err := naclfs.Open(backing, naclfs.FromKeyring(naclfs.NewKeyring(1, Key("other")))); err != naclfs.ErrWrongKey {
+		t.Errorf("Expected wrong key to be rejected, got %v", err)
+	}
+	ring.Add(2, Key("second"))
+	ring.SetActive(2)
+	if _, err := naclfs.Open(backing, naclfs.FromKeyring(ring)); err == nil {
+		t.Errorf("Opening with a key that is not recorded should fail")
+	}
+	if err := naclfs.UpdateKeyring(backing, naclfs.NewKeyring(2, Key("other"))); err != naclfs.ErrWrongKey {
+		t.Errorf("Updating without a recorded key should fail, got %v", err)
+	}
+	if err := naclfs.UpdateKeyring(backing, ring); err != nil {
+		t.Fatal(err)
+	}
+	conflicting := naclfs.NewKeyring(1, Key("first"))
+	conflicting.Add(2, Key("other"))
+	if err := naclfs.UpdateKeyring(backing, conflicting); err != naclfs.ErrWrongKey {
+		t.Errorf("Expected conflicting key to be rejected, got %v", err)
+	}
+	fs, err = naclfs.Open(backing, naclfs.FromKeyring(ring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := naclfs.Reencrypt(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ids := keyIDs(t, backing, "/file"); !equalIDs(ids, []uint32{2, 2}) {
+		t.Errorf("Expected re-encrypted blocks to use key 2, got %v", ids)
+	}
+	fs, err = naclfs.Open(backing, naclfs.FromKeyring(naclfs.NewKeyring(2, Key("second"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := afero.ReadFile(fs, "/file"); err != nil || string(data) != "written with the first key" {
+		t.Errorf("Reading with the second key only failed: %q, %v", data, err)
+	}
+
+	// Trees without a keyring are opened with the active key
+	plain := afero.NewMemMapFs()
+	naclfs.Init(plain, Key("second"), nil)
+	if _, err := naclfs.Open(plain, naclfs.FromKeyring(ring)); err != nil {
+		t.Errorf("Opening a tree without keyring failed: %v", err)
+	}
+	if _, err := naclfs.InitKeyring(afero.NewMemMapFs(), ring, &naclfs.Options{NameEncryption: true}); err == nil {
+		t.Errorf("Name encryption should be rejected")
+	}
+}
+
+func equalIDs(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -10,7 +10,7 @@ import (
 
 const FS_NAME = "naclfs"
 
-func New(blockSize int64, key *[32]byte, backing afero.Fs) afero.Fs {
+func New(blockSize int64, key *[32]byte, backing afero.Fs, opts ...trfs.Option) afero.Fs {
 
 	readTr := func() transform.Transformer {
 		return nacltr.NewDecryptTransformer(key, blockSize)
@@ -25,5 +25,31 @@ func New(blockSize int64, key *[32]byte, backing afero.Fs) afero.Fs {
 		FS_NAME,
 		backing,
 		readTr, writeTr,
+		opts...,
 	)
 }
+
+/*
+WithNameEncryption encrypts file and directory names with a key derived
+from the given key
+*/
+func WithNameEncryption(key *[32]byte) trfs.Option {
+	return trfs.WithNameTransformer(nacltr.NewNameTransformer(key))
+}
+
+/*
+NewCodec returns the naclfs encryption as a codec, to be chained with
+other codecs in trfs.NewChainFs
+*/
+func NewCodec(key *[32]byte) trfs.Codec {
+	return trfs.Codec{
+		Name:     Codec,
+		Overhead: nacltr.NONCE_SIZE + secretbox.Overhead,
+		NewReadTransformer: func(blockSize int64) transform.Transformer {
+			return nacltr.NewDecryptTransformer(key, blockSize)
+		},
+		NewWriteTransformer: func(blockSize int64) transform.Transformer {
+			return nacltr.NewEncryptTransformer(key, blockSize)
+		},
+	}
+}
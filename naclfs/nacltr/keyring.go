@@ -0,0 +1,92 @@
+package nacltr
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/text/transform"
+)
+
+// KEY_ID_SIZE is the size of the key ID in front of blocks encrypted with a keyring
+const KEY_ID_SIZE = 4
+
+type keyringEncryptTransformer struct {
+	active func() (uint32, *[32]byte)
+}
+
+type keyringDecryptTransformer struct {
+	keys func(id uint32) *[32]byte
+}
+
+/*
+NewKeyringEncryptTransformer encrypts whole blocks like the secretbox
+transformer, with the key active is returning when the block is written.
+The ID of the key is recorded in front of the nonce.
+*/
+func NewKeyringEncryptTransformer(active func() (uint32, *[32]byte)) transform.Transformer {
+	return &keyringEncryptTransformer{active}
+}
+
+/*
+NewKeyringDecryptTransformer decrypts whole blocks written by a keyring
+encrypt transformer, with the key keys returns for the ID of the block. keys
+returns nil for unknown IDs.
+*/
+func NewKeyringDecryptTransformer(keys func(id uint32) *[32]byte) transform.Transformer {
+	return &keyringDecryptTransformer{keys}
+}
+
+func (t *keyringEncryptTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !atEOF {
+		return 0, 0, transform.ErrShortSrc
+	}
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+	n := KEY_ID_SIZE + NONCE_SIZE + secretbox.Overhead + len(src)
+	if len(dst) < n {
+		return 0, 0, transform.ErrShortDst
+	}
+	id, key := t.active()
+	var nonce [NONCE_SIZE]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return 0, 0, err
+	}
+	binary.BigEndian.PutUint32(dst, id)
+	copy(dst[KEY_ID_SIZE:], nonce[:])
+	secretbox.Seal(dst[KEY_ID_SIZE+NONCE_SIZE:KEY_ID_SIZE+NONCE_SIZE], src, &nonce, key)
+	return n, len(src), nil
+}
+
+func (t *keyringDecryptTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !atEOF {
+		return 0, 0, transform.ErrShortSrc
+	}
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+	if len(src) < KEY_ID_SIZE+NONCE_SIZE+secretbox.Overhead {
+		return 0, len(src), errDecrypt
+	}
+	n := len(src) - KEY_ID_SIZE - NONCE_SIZE - secretbox.Overhead
+	if len(dst) < n {
+		return 0, 0, transform.ErrShortDst
+	}
+	id := binary.BigEndian.Uint32(src)
+	key := t.keys(id)
+	if key == nil {
+		return 0, len(src), fmt.Errorf("Unknown key ID %d", id)
+	}
+	var nonce [NONCE_SIZE]byte
+	copy(nonce[:], src[KEY_ID_SIZE:])
+	if _, ok := secretbox.Open(dst[:0], src[KEY_ID_SIZE+NONCE_SIZE:], &nonce, key); !ok {
+		return 0, len(src), errDecrypt
+	}
+	return n, len(src), nil
+}
+
+func (t *keyringEncryptTransformer) Reset() {}
+
+func (t *keyringDecryptTransformer) Reset() {}
@@ -0,0 +1,50 @@
+package nacltr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/text/transform"
+)
+
+func TestKeyringTransformer(t *testing.T) {
+	var key1, key2 [32]byte
+	copy(key1[:], "first")
+	copy(key2[:], "second")
+	keys := map[uint32]*[32]byte{1: &key1, 2: &key2}
+	secret := []byte("secret")
+
+	enc, _, err := transform.Bytes(NewKeyringEncryptTransformer(func() (uint32, *[32]byte) {
+		return 2, &key2
+	}), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.BigEndian.Uint32(enc); id != 2 {
+		t.Errorf("Expected key ID 2, got %d", id)
+	}
+	dec, _, err := transform.Bytes(NewKeyringDecryptTransformer(func(id uint32) *[32]byte {
+		return keys[id]
+	}), enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, secret) {
+		t.Errorf("Retrieved text %q does not match input", dec)
+	}
+
+	delete(keys, 2)
+	if _, _, err := transform.Bytes(NewKeyringDecryptTransformer(func(id uint32) *[32]byte {
+		return keys[id]
+	}), enc); err == nil {
+		t.Errorf("Expected decryption with unknown key ID to fail")
+	}
+	// A block claiming to be encrypted with another key
+	binary.BigEndian.PutUint32(enc, 1)
+	if _, _, err := transform.Bytes(NewKeyringDecryptTransformer(func(id uint32) *[32]byte {
+		return keys[id]
+	}), enc); err != errDecrypt {
+		t.Errorf("Expected decryption with wrong key to fail, got %v", err)
+	}
+}
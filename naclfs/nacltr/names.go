@@ -0,0 +1,82 @@
+package nacltr
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+const sivSize = 16
+
+var errDecryptName = errors.New("could not decrypt or authenticate name")
+
+/*
+NameTransformer deterministically encrypts file names using a SIV
+construction: a synthetic IV is derived from the directory IV and the name
+with HMAC-SHA256, then the name is encrypted with AES-CTR under that IV.
+Encrypted names are encoded as unpadded base64url, so they never contain
+path separators or start with a dot.
+*/
+type NameTransformer struct {
+	encKey []byte
+	macKey []byte
+}
+
+// Derives a sub key for a specific purpose from the master key
+func deriveKey(key *[32]byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func NewNameTransformer(key *[32]byte) *NameTransformer {
+	return &NameTransformer{
+		encKey: deriveKey(key, "trfs name encryption"),
+		macKey: deriveKey(key, "trfs name authentication"),
+	}
+}
+
+func (t *NameTransformer) siv(name, iv []byte) []byte {
+	mac := hmac.New(sha256.New, t.macKey)
+	mac.Write(iv)
+	mac.Write(name)
+	return mac.Sum(nil)[:sivSize]
+}
+
+func (t *NameTransformer) xorKeyStream(dst, src, siv []byte) error {
+	block, err := aes.NewCipher(t.encKey)
+	if err != nil {
+		return err
+	}
+	cipher.NewCTR(block, siv).XORKeyStream(dst, src)
+	return nil
+}
+
+func (t *NameTransformer) EncryptName(name string, iv []byte) (string, error) {
+	siv := t.siv([]byte(name), iv)
+	res := make([]byte, sivSize+len(name))
+	copy(res, siv)
+	if err := t.xorKeyStream(res[sivSize:], []byte(name), siv); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(res), nil
+}
+
+func (t *NameTransformer) DecryptName(name string, iv []byte) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(data) <= sivSize {
+		return "", errDecryptName
+	}
+	siv := data[:sivSize]
+	plain := make([]byte, len(data)-sivSize)
+	if err := t.xorKeyStream(plain, data[sivSize:], siv); err != nil {
+		return "", err
+	}
+	if !hmac.Equal(siv, t.siv(plain, iv)) {
+		return "", errDecryptName
+	}
+	return string(plain), nil
+}
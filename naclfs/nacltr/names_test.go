@@ -0,0 +1,42 @@
+package nacltr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNameTransformer(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "passcode")
+	tr := NewNameTransformer(&key)
+	iv1 := []byte("0123456789abcdef")
+	iv2 := []byte("fedcba9876543210")
+
+	enc, err := tr.EncryptName("secret.txt", iv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(enc, "secret") || strings.ContainsAny(enc, "/.") {
+		t.Errorf("Unexpected encrypted name %q", enc)
+	}
+	if again, _ := tr.EncryptName("secret.txt", iv1); again != enc {
+		t.Errorf("Encryption is not deterministic: %q != %q", again, enc)
+	}
+	if other, _ := tr.EncryptName("secret.txt", iv2); other == enc {
+		t.Errorf("Different IVs should give different names")
+	}
+
+	dec, err := tr.DecryptName(enc, iv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec != "secret.txt" {
+		t.Errorf("Unexpected decrypted name %q", dec)
+	}
+	if _, err := tr.DecryptName(enc, iv2); err != errDecryptName {
+		t.Errorf("Expected decryption with wrong IV to fail, got %v", err)
+	}
+	if _, err := tr.DecryptName("plain", iv1); err != errDecryptName {
+		t.Errorf("Expected decryption of plain name to fail, got %v", err)
+	}
+}
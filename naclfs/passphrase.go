@@ -0,0 +1,180 @@
+package naclfs
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs/nacltr"
+	"github.com/tobiash/go-transformfile/trfs"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const saltSize = 16
+
+var (
+	errNoPassphrase    = fmt.Errorf("key of filesystem is not protected by a passphrase")
+	errRekeyInProgress = fmt.Errorf("filesystem is being rekeyed")
+)
+
+/*
+DefaultKDF returns the parameters InitPassphrase uses if none are given,
+Argon2id with the cost recommended by RFC 9106 for memory constrained
+environments
+*/
+func DefaultKDF() *trfs.KDFParams {
+	return &trfs.KDFParams{
+		Algorithm: trfs.KDFArgon2id,
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+	}
+}
+
+// Derives the key wrapping the master key
+func deriveKey(passphrase []byte, kdf *trfs.KDFParams) (*[32]byte, error) {
+	var (
+		b   []byte
+		err error
+	)
+	switch kdf.Algorithm {
+	case trfs.KDFScrypt:
+		b, err = scrypt.Key(passphrase, kdf.Salt, kdf.N, kdf.R, kdf.P, 32)
+	case trfs.KDFArgon2id:
+		if kdf.Time == 0 || kdf.Threads == 0 || kdf.Memory < 8*uint32(kdf.Threads) {
+			return nil, fmt.Errorf("Invalid Argon2id parameters")
+		}
+		b = argon2.IDKey(passphrase, kdf.Salt, kdf.Time, kdf.Memory, kdf.Threads, 32)
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation %q", kdf.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := new([32]byte)
+	copy(key[:], b)
+	return key, nil
+}
+
+/*
+Encrypts the master key with a key derived from the passphrase, recording
+the parameters with a new salt in the config
+*/
+func wrapKey(cfg *trfs.Config, key *[32]byte, passphrase []byte, kdf *trfs.KDFParams) error {
+	params := *kdf
+	params.Salt = make([]byte, saltSize)
+	if _, err := rand.Read(params.Salt); err != nil {
+		return err
+	}
+	kek, err := deriveKey(passphrase, &params)
+	if err != nil {
+		return err
+	}
+	wrapped, err := sealKey(key, kek)
+	if err != nil {
+		return err
+	}
+	cfg.KDF, cfg.WrappedKey = &params, wrapped
+	return nil
+}
+
+// Encrypts the master key with the key derived from the passphrase
+func sealKey(key, kek *[32]byte) ([]byte, error) {
+	var nonce [nacltr.NONCE_SIZE]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], key[:], &nonce, kek), nil
+}
+
+// Decrypts the master key, failing with ErrWrongKey for a wrong passphrase
+func unwrapKey(cfg *trfs.Config, passphrase []byte) (*[32]byte, error) {
+	if cfg.KDF == nil || len(cfg.WrappedKey) < nacltr.NONCE_SIZE {
+		return nil, errNoPassphrase
+	}
+	kek, err := deriveKey(passphrase, cfg.KDF)
+	if err != nil {
+		return nil, err
+	}
+	return openKey(cfg.WrappedKey, kek)
+}
+
+func openKey(wrapped []byte, kek *[32]byte) (*[32]byte, error) {
+	if len(wrapped) < nacltr.NONCE_SIZE {
+		return nil, ErrWrongKey
+	}
+	var nonce [nacltr.NONCE_SIZE]byte
+	copy(nonce[:], wrapped)
+	b, ok := secretbox.Open(nil, wrapped[nacltr.NONCE_SIZE:], &nonce, kek)
+	if !ok || len(b) != 32 {
+		return nil, ErrWrongKey
+	}
+	key := new([32]byte)
+	copy(key[:], b)
+	return key, nil
+}
+
+/*
+Passphrase provides the key of a tree created with InitPassphrase, by
+decrypting it with a key derived from the passphrase
+*/
+func Passphrase(passphrase []byte) KeyProvider {
+	return KeyProviderFunc(func(cfg *trfs.Config) (*[32]byte, error) {
+		return unwrapKey(cfg, passphrase)
+	})
+}
+
+/*
+InitPassphrase initialises a new naclfs tree like Init, with a random key
+that is stored in the config, encrypted with a key derived from the
+passphrase. kdf sets the algorithm and cost of the derivation, DefaultKDF
+is used if it is nil; the salt is always chosen randomly. The tree is
+opened with Open and Passphrase.
+*/
+func InitPassphrase(backing afero.Fs, passphrase []byte, kdf *trfs.KDFParams, opts *Options) (afero.Fs, error) {
+	if kdf == nil {
+		kdf = DefaultKDF()
+	}
+	key := new([32]byte)
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	cfg := newConfig(key, opts)
+	if err := wrapKey(cfg, key, passphrase, kdf); err != nil {
+		return nil, err
+	}
+	if err := trfs.WriteConfig(backing, cfg); err != nil {
+		return nil, err
+	}
+	return fromConfig(backing, cfg, key), nil
+}
+
+/*
+ChangePassphrase changes the passphrase protecting the key of a tree
+created with InitPassphrase. Data is not re-encrypted, as the key stays
+the same. kdf sets the cost of deriving the key from the new passphrase,
+the previous cost is kept if it is nil. Fails while an interrupted Rekey
+has not been completed.
+*/
+func ChangePassphrase(backing afero.Fs, oldPassphrase, newPassphrase []byte, kdf *trfs.KDFParams) error {
+	cfg, err := trfs.ReadConfig(backing)
+	if err != nil {
+		return err
+	}
+	if cfg.PreviousWrappedKey != nil {
+		return errRekeyInProgress
+	}
+	key, err := unwrapKey(cfg, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	if kdf == nil {
+		kdf = cfg.KDF
+	}
+	if err := wrapKey(cfg, key, newPassphrase, kdf); err != nil {
+		return err
+	}
+	return trfs.ReplaceConfig(backing, cfg)
+}
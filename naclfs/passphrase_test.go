@@ -0,0 +1,55 @@
+package naclfs_test
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func TestPassphrase(t *testing.T) {
+	for _, kdf := range []*trfs.KDFParams{
+		{Algorithm: trfs.KDFScrypt, N: 16, R: 8, P: 1},
+		{Algorithm: trfs.KDFArgon2id, Time: 1, Memory: 64, Threads: 1},
+	} {
+		backing := afero.NewMemMapFs()
+		fs, err := naclfs.InitPassphrase(backing, []byte("first"), kdf, &naclfs.Options{BlockSize: 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := afero.WriteFile(fs, "/file", []byte("protected by a passphrase"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := naclfs.Open(backing, naclfs.Passphrase([]byte("wrong"))); err != naclfs.ErrWrongKey {
+			t.Errorf("Expected wrong passphrase to be detected, got %v", err)
+		}
+
+		if err := naclfs.ChangePassphrase(backing, []byte("wrong"), []byte("second"), nil); err != naclfs.ErrWrongKey {
+			t.Errorf("Expected change with wrong passphrase to fail, got %v", err)
+		}
+		if err := naclfs.ChangePassphrase(backing, []byte("first"), []byte("second"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := naclfs.Open(backing, naclfs.Passphrase([]byte("first"))); err != naclfs.ErrWrongKey {
+			t.Errorf("Expected previous passphrase to be rejected, got %v", err)
+		}
+		fs, err = naclfs.Open(backing, naclfs.Passphrase([]byte("second")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, err := afero.ReadFile(fs, "/file"); err != nil || string(d) != "protected by a passphrase" {
+			t.Errorf("Unexpected contents %q, %v", d, err)
+		}
+		cfg, _ := trfs.ReadConfig(backing)
+		if cfg.KDF.Algorithm != kdf.Algorithm || len(cfg.KDF.Salt) == 0 {
+			t.Errorf("Unexpected derivation parameters %+v", cfg.KDF)
+		}
+	}
+
+	backing := afero.NewMemMapFs()
+	naclfs.Init(backing, Key("raw"), nil)
+	if _, err := naclfs.Open(backing, naclfs.Passphrase([]byte("first"))); err == nil {
+		t.Errorf("Tree without passphrase should not open with one")
+	}
+}
@@ -0,0 +1,135 @@
+package naclfs
+
+import (
+	"crypto/hmac"
+	"fmt"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+/*
+Params are the parameters files of a naclfs tree are encoded with
+*/
+type Params struct {
+	Key       *[32]byte
+	BlockSize int64
+	// Passphrase of a tree created with InitPassphrase, only used for the source
+	Passphrase []byte
+}
+
+var (
+	errRekeyNames      = fmt.Errorf("trees with encrypted names can not be rekeyed")
+	errRekeyPassphrase = fmt.Errorf("passphrase of the source is needed to protect the new key")
+	errRekeySourceKey  = fmt.Errorf("key of the source has to be given")
+)
+
+/*
+Rekey re-encodes every file of the tree on the backing filesystem from the
+src parameters to the dst parameters, to rotate the key or change the
+block size. The config is updated to the dst parameters first, so the tree
+has to be opened with them afterwards. A zero block size in dst is kept
+from src. A zero block size in src is taken from the config, as long as it
+has not been updated; resuming an interrupted run or changing only the
+block size needs it to be given.
+
+The key of a tree created with InitPassphrase is taken from the config if
+src has a passphrase and no key. The new key is protected by the same
+passphrase and key derivation, so the tree is still opened with
+Passphrase.
+
+Rekey is crash-safe, see trfs.Reencode: an interrupted run continues when
+Rekey is called again with the same parameters. progress is called after
+each file and may be nil. Trees with encrypted names are not supported.
+*/
+func Rekey(backing afero.Fs, src, dst Params, progress func(trfs.Progress)) error {
+	if dst.Key == nil {
+		return fmt.Errorf("Key of the destination has to be given")
+	}
+	cfg, err := trfs.ReadConfig(backing)
+	if err != nil && err != trfs.ErrNoConfig {
+		return err
+	}
+	if cfg != nil {
+		if cfg.Codec != Codec {
+			return fmt.Errorf("Unsupported codec %q", cfg.Codec)
+		}
+		if cfg.MaxNameLength > 0 {
+			return errRekeyNames
+		}
+		// The config has already been updated if an earlier run was interrupted
+		updated := hmac.Equal(cfg.KeyVerifier, keyVerifier(dst.Key))
+		if cfg.KDF != nil {
+			if err := rewrapKey(cfg, &src, dst.Key, updated); err != nil {
+				return err
+			}
+		}
+		if src.Key == nil {
+			return errRekeySourceKey
+		}
+		if !updated && !hmac.Equal(cfg.KeyVerifier, keyVerifier(src.Key)) {
+			return ErrWrongKey
+		}
+		if src.BlockSize == 0 && !updated {
+			src.BlockSize = cfg.BlockSize
+		}
+	}
+	if src.Key == nil {
+		return errRekeySourceKey
+	}
+	if src.BlockSize <= 0 {
+		return fmt.Errorf("Block size of the source has to be given")
+	}
+	if dst.BlockSize == 0 {
+		dst.BlockSize = src.BlockSize
+	}
+	if dst.BlockSize <= 0 {
+		return fmt.Errorf("Invalid block size %d", dst.BlockSize)
+	}
+	if cfg != nil {
+		cfg.BlockSize, cfg.KeyVerifier = dst.BlockSize, keyVerifier(dst.Key)
+		if err := trfs.ReplaceConfig(backing, cfg); err != nil {
+			return err
+		}
+	}
+	err = trfs.Reencode(
+		New(src.BlockSize, src.Key, backing),
+		New(dst.BlockSize, dst.Key, backing),
+		progress,
+	)
+	if err != nil || cfg == nil || cfg.PreviousWrappedKey == nil {
+		return err
+	}
+	cfg.PreviousWrappedKey = nil
+	return trfs.ReplaceConfig(backing, cfg)
+}
+
+/*
+Wraps the new key of a tree protected by a passphrase in the config,
+keeping the previous key until the rekey completes. Takes the key of the
+source from the config if it is not given.
+*/
+func rewrapKey(cfg *trfs.Config, src *Params, key *[32]byte, updated bool) error {
+	if src.Passphrase == nil {
+		return errRekeyPassphrase
+	}
+	kek, err := deriveKey(src.Passphrase, cfg.KDF)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		cfg.PreviousWrappedKey = cfg.WrappedKey
+	}
+	if src.Key == nil {
+		if src.Key, err = openKey(cfg.PreviousWrappedKey, kek); err != nil {
+			return err
+		}
+	}
+	if updated {
+		// The passphrase has to match the key already wrapped
+		_, err := openKey(cfg.WrappedKey, kek)
+		return err
+	}
+	cfg.WrappedKey, err = sealKey(key, kek)
+	return err
+}
@@ -0,0 +1,155 @@
+package naclfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+// Fails renames after the given number of them
+type failingRenameFs struct {
+	afero.Fs
+	renames int
+}
+
+func (fs *failingRenameFs) Rename(oldname, newname string) error {
+	if fs.renames == 0 {
+		return fmt.Errorf("interrupted")
+	}
+	fs.renames--
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func TestRekey(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs, err := naclfs.Init(backing, Key("old"), &naclfs.Options{BlockSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"/a.txt":     []byte("first file"),
+		"/dir/b.bin": bytes.Repeat([]byte("second file "), 10),
+		"/dir/c.txt": nil,
+	}
+	for name, data := range files {
+		if err := afero.WriteFile(fs, name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.(trfs.Attributer).SetAttr("/a.txt", "user.tag", []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+
+	src := naclfs.Params{Key: Key("old")}
+	dst := naclfs.Params{Key: Key("new"), BlockSize: 32}
+	// Interrupted after replacing the config and converting one file
+	if err := naclfs.Rekey(&failingRenameFs{backing, 2}, src, dst, nil); err == nil {
+		t.Fatalf("Rekey should have been interrupted")
+	}
+	if _, err := naclfs.Open(backing, naclfs.StaticKey(Key("old"))); err != naclfs.ErrWrongKey {
+		t.Errorf("Expected config to be updated, got %v", err)
+	}
+	if err := naclfs.Rekey(backing, src, naclfs.Params{Key: Key("other")}, nil); err != naclfs.ErrWrongKey {
+		t.Errorf("Expected unrelated key to be rejected, got %v", err)
+	}
+	if err := naclfs.Rekey(backing, src, dst, nil); err == nil {
+		t.Errorf("Resuming should need the block size of the source")
+	}
+	src.BlockSize = 16
+
+	var last trfs.Progress
+	calls := 0
+	err = naclfs.Rekey(backing, src, dst, func(p trfs.Progress) {
+		calls++
+		last = p
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 || last.Files != int64(calls) || last.Files != last.TotalFiles || last.Bytes != last.TotalBytes {
+		t.Errorf("Unexpected progress after %d calls: %+v", calls, last)
+	}
+
+	fs, err = naclfs.Open(backing, naclfs.StaticKey(Key("new")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if d, err := afero.ReadFile(fs, name); err != nil || !bytes.Equal(d, data) {
+			t.Errorf("Unexpected contents of %s: %q, %v", name, d, err)
+		}
+	}
+	if v, err := fs.(trfs.Attributer).GetAttr("/a.txt", "user.tag"); err != nil || string(v) != "kept" {
+		t.Errorf("Unexpected attribute %q, %v", v, err)
+	}
+	if _, err := backing.Stat(trfs.ReencodeName); err == nil {
+		t.Errorf("Checkpoint should have been removed")
+	}
+}
+
+func TestRekeyMissingKey(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	if _, err := naclfs.Init(backing, Key("old"), &naclfs.Options{BlockSize: 16}); err != nil {
+		t.Fatal(err)
+	}
+	if err := naclfs.Rekey(backing, naclfs.Params{}, naclfs.Params{Key: Key("new")}, nil); err == nil {
+		t.Errorf("Rekey without the key of the source should fail")
+	}
+	if _, err := naclfs.Open(backing, naclfs.StaticKey(Key("old"))); err != nil {
+		t.Errorf("Config should be unchanged, got %v", err)
+	}
+}
+
+func TestRekeyPassphrase(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	kdf := &trfs.KDFParams{Algorithm: trfs.KDFScrypt, N: 16, R: 8, P: 1}
+	fs, err := naclfs.InitPassphrase(backing, []byte("secret"), kdf, &naclfs.Options{BlockSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"/a.txt": []byte("first file"),
+		"/b.txt": bytes.Repeat([]byte("second file "), 10),
+	}
+	for name, data := range files {
+		if err := afero.WriteFile(fs, name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := naclfs.Params{Key: Key("new")}
+	if err := naclfs.Rekey(backing, naclfs.Params{Key: Key("old")}, dst, nil); err == nil {
+		t.Errorf("Rekey should need the passphrase to protect the new key")
+	}
+	src := naclfs.Params{Passphrase: []byte("secret")}
+	if err := naclfs.Rekey(&failingRenameFs{backing, 2}, src, dst, nil); err == nil {
+		t.Fatalf("Rekey should have been interrupted")
+	}
+	if err := naclfs.ChangePassphrase(backing, []byte("secret"), []byte("other"), nil); err == nil {
+		t.Errorf("Changing the passphrase should fail during a rekey")
+	}
+	src.BlockSize = 16
+	if err := naclfs.Rekey(backing, src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = naclfs.Open(backing, naclfs.Passphrase([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if d, err := afero.ReadFile(fs, name); err != nil || !bytes.Equal(d, data) {
+			t.Errorf("Unexpected contents of %s: %q, %v", name, d, err)
+		}
+	}
+	if _, err := naclfs.Open(backing, naclfs.StaticKey(Key("new"))); err != nil {
+		t.Errorf("Tree should be encrypted with the new key: %v", err)
+	}
+	if cfg, err := trfs.ReadConfig(backing); err != nil || cfg.PreviousWrappedKey != nil || cfg.KDF.Algorithm != trfs.KDFScrypt {
+		t.Errorf("Unexpected config after rekey %+v, %v", cfg, err)
+	}
+}
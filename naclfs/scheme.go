@@ -0,0 +1,159 @@
+package naclfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func init() {
+	transformfile.RegisterLayer(FS_NAME, openLayer)
+	transformfile.RegisterCodec("secretbox", func(p *transformfile.Params) (trfs.Codec, error) {
+		key, err := keyParam(p, "key")
+		if err != nil {
+			return trfs.Codec{}, err
+		}
+		return NewCodec(key), nil
+	})
+	transformfile.RegisterCodec("keyring", func(p *transformfile.Params) (trfs.Codec, error) {
+		keys, err := keyringParam(p)
+		if err != nil {
+			return trfs.Codec{}, err
+		}
+		return NewKeyringCodec(keys), nil
+	})
+}
+
+// Resolves a key parameter to a naclfs key
+func keyParam(p *transformfile.Params, name string) (*[32]byte, error) {
+	b, err := p.Key(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("Key of %s has %d bytes instead of 32", p.Scheme, len(b))
+	}
+	key := new([32]byte)
+	copy(key[:], b)
+	return key, nil
+}
+
+/*
+Resolves the keyring parameter, a comma separated list of key IDs. The key
+of each ID is given by the key parameter suffixed with the ID, like
+"key1", the active key by the parameter active, defaulting to the first ID
+in the list.
+*/
+func keyringParam(p *transformfile.Params) (*Keyring, error) {
+	if p.Get("keyring") == "" {
+		return nil, fmt.Errorf("Missing parameter keyring of %s", p.Scheme)
+	}
+	var keys *Keyring
+	for _, v := range strings.Split(p.Get("keyring"), ",") {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key ID %q in keyring of %s", v, p.Scheme)
+		}
+		key, err := keyParam(p, "key"+v)
+		if err != nil {
+			return nil, err
+		}
+		if keys == nil {
+			keys = NewKeyring(uint32(id), key)
+		} else if err := keys.Add(uint32(id), key); err != nil {
+			return nil, err
+		}
+	}
+	active, err := p.Int("active", int64(keys.Active()))
+	if err != nil {
+		return nil, err
+	}
+	if err := keys.SetActive(uint32(active)); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+/*
+Opens naclfs for transformfile.OpenFs. Parameters are the key, the block
+size, defaulting to DefaultBlockSize, names to encrypt names and readOnly
+for a read-only view. Instead of the key, trees created with
+InitPassphrase take the passphrase, resolved like a key, and trees with a
+keyring take the keyring, see keyringParam. Trees with a config are opened
+with the parameters recorded in it, block size and names fail if they are
+given and differ.
+*/
+func openLayer(backing afero.Fs, p *transformfile.Params) (afero.Fs, error) {
+	var (
+		keys KeyProvider
+		key  *[32]byte
+		ring *Keyring
+		err  error
+	)
+	switch {
+	case p.Get("keyring") != "":
+		if ring, err = keyringParam(p); err != nil {
+			return nil, err
+		}
+		keys = FromKeyring(ring)
+	case p.Get("passphrase") != "":
+		passphrase, err := p.Key("passphrase")
+		if err != nil {
+			return nil, err
+		}
+		keys = Passphrase(passphrase)
+	default:
+		if key, err = keyParam(p, "key"); err != nil {
+			return nil, err
+		}
+		keys = StaticKey(key)
+	}
+	readOnly, err := p.Bool("readOnly")
+	if err != nil {
+		return nil, err
+	}
+	var opts []trfs.Option
+	if readOnly {
+		opts = append(opts, trfs.WithReadOnly())
+	}
+	blockSize, err := p.Int("blockSize", DefaultBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("Invalid block size %d", blockSize)
+	}
+	names, err := p.Bool("names")
+	if err != nil {
+		return nil, err
+	}
+	if cfg, err := trfs.ReadConfig(backing); err != trfs.ErrNoConfig {
+		if err != nil {
+			return nil, err
+		}
+		if p.Get("blockSize") != "" && blockSize != cfg.BlockSize {
+			return nil, fmt.Errorf("Block size %d of %s conflicts with %d of the config", blockSize, p.Scheme, cfg.BlockSize)
+		}
+		if p.Get("names") != "" && names != (cfg.MaxNameLength != 0) {
+			return nil, fmt.Errorf("Name encryption of %s conflicts with the config", p.Scheme)
+		}
+		return Open(backing, keys, opts...)
+	}
+	switch {
+	case ring != nil:
+		if names {
+			return nil, errKeyringNames
+		}
+		return NewWithKeyring(blockSize, ring, backing, opts...), nil
+	case key == nil:
+		return nil, fmt.Errorf("Passphrase of %s needs a tree created with InitPassphrase", p.Scheme)
+	}
+	if names {
+		opts = append(opts, WithNameEncryption(key))
+	}
+	return New(blockSize, key, backing, opts...), nil
+}
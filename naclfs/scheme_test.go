@@ -0,0 +1,186 @@
+package naclfs_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func TestOpenFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naclfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := strings.Repeat("ab", 32)
+	os.Setenv("NACLFS_TEST_KEY", key)
+	defer os.Unsetenv("NACLFS_TEST_KEY")
+
+	fs, err := transformfile.OpenFs("naclfs+file://" + dir + "?blockSize=16&key=env:NACLFS_TEST_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/file", []byte("opened by url"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := ioutil.ReadFile(dir + "/file"); strings.Contains(string(raw), "opened") {
+		t.Errorf("Contents are stored in plaintext")
+	}
+	fs, err = transformfile.OpenFs("naclfs+file://" + dir + "?blockSize=16&key=hex:" + key + "&readOnly=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(fs, "/file"); err != nil || string(d) != "opened by url" {
+		t.Errorf("Unexpected contents %q, %v", d, err)
+	}
+	if err := fs.Remove("/file"); !os.IsPermission(err) {
+		t.Errorf("Expected read-only filesystem, got %v", err)
+	}
+
+	// Layers of the same scheme get their parameters by position
+	other := strings.Repeat("cd", 32)
+	os.Mkdir(dir+"/chain", 0755)
+	fs, err = transformfile.OpenFs("naclfs+naclfs+file://" + dir + "/chain?0.key=hex:" + other + "&1.key=hex:" + key + "&1.blockSize=64&blockSize=32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/file", []byte("chained"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(fs, "/file"); err != nil || string(d) != "chained" {
+		t.Errorf("Unexpected contents %q, %v", d, err)
+	}
+	inner, err := transformfile.OpenFs("naclfs+file://" + dir + "/chain?blockSize=64&key=hex:" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(inner, "/file"); err != nil || strings.Contains(string(d), "chained") {
+		t.Errorf("Inner layer should hold the outer ciphertext: %q, %v", d, err)
+	}
+
+	// Trees with a config are opened with its parameters
+	os.Mkdir(dir+"/tree", 0755)
+	naclfs.Init(afero.NewBasePathFs(afero.NewOsFs(), dir+"/tree"), Key("config"), &naclfs.Options{BlockSize: 16})
+	if _, err := transformfile.OpenFs("naclfs+file://" + dir + "/tree?key=hex:" + key); err != naclfs.ErrWrongKey {
+		t.Errorf("Expected key to be checked against the config, got %v", err)
+	}
+	configKey := fmt.Sprintf("hex:%x", Key("config")[:])
+	for _, query := range []string{"&blockSize=32", "&names=true"} {
+		if _, err := transformfile.OpenFs("naclfs+file://" + dir + "/tree?key=" + configKey + query); err == nil {
+			t.Errorf("Expected %s to conflict with the config", query)
+		}
+	}
+	if _, err := transformfile.OpenFs("naclfs+file://" + dir + "/tree?key=" + configKey + "&blockSize=16&names=false"); err != nil {
+		t.Errorf("Parameters matching the config should be accepted: %v", err)
+	}
+	if _, err := transformfile.OpenFs("naclfs+mem://?key=hex:abcd"); err == nil {
+		t.Errorf("Expected short key to be rejected")
+	}
+}
+
+func TestOpenFsChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naclfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := fmt.Sprintf("hex:%x", Key("chain")[:])
+	data := bytes.Repeat([]byte("compress then encrypt "), 20)
+
+	fs, err := transformfile.OpenFs("trfs+deflate+secretbox+file://" + dir + "?blockSize=64&level=9&key=" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := ioutil.ReadFile(dir + "/file"); bytes.Contains(raw, data[:16]) {
+		t.Errorf("Contents are stored in plaintext")
+	}
+	// The URL opens the same chain as the constructor
+	codecs := []trfs.Codec{trfs.DeflateCodec(flate.BestCompression), naclfs.NewCodec(Key("chain"))}
+	direct := trfs.NewChainFs(64, trfs.ChainFsName, afero.NewBasePathFs(afero.NewOsFs(), dir), codecs)
+	if d, err := afero.ReadFile(direct, "/file"); err != nil || !bytes.Equal(d, data) {
+		t.Errorf("Unexpected contents through the constructor %q, %v", d, err)
+	}
+	fs, err = transformfile.OpenFs("trfs+deflate+secretbox+file://" + dir + "?blockSize=64&key=" + key + "&readOnly=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(fs, "/file"); err != nil || !bytes.Equal(d, data) {
+		t.Errorf("Unexpected contents %q, %v", d, err)
+	}
+	if err := fs.Remove("/file"); !os.IsPermission(err) {
+		t.Errorf("Expected read-only filesystem, got %v", err)
+	}
+	for _, u := range []string{
+		"trfs+deflate+secretbox+mem://?key=" + key,
+		"trfs+deflate+mem://?blockSize=64&level=10",
+		"trfs+keyring+mem://?blockSize=64&keyring=1&key2=" + key,
+	} {
+		if _, err := transformfile.OpenFs(u); err == nil {
+			t.Errorf("Expected %s to fail", u)
+		}
+	}
+}
+
+func TestOpenFsPassphraseKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naclfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/pass", 0755)
+	os.Mkdir(dir+"/ring", 0755)
+
+	kdf := &trfs.KDFParams{Algorithm: trfs.KDFScrypt, N: 16, R: 8, P: 1}
+	fs, err := naclfs.InitPassphrase(afero.NewBasePathFs(afero.NewOsFs(), dir+"/pass"), []byte("secret"), kdf, &naclfs.Options{BlockSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	afero.WriteFile(fs, "/file", []byte("protected"), 0644)
+	fs, err = transformfile.OpenFs(fmt.Sprintf("naclfs+file://%s/pass?passphrase=hex:%x", dir, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(fs, "/file"); err != nil || string(d) != "protected" {
+		t.Errorf("Unexpected contents %q, %v", d, err)
+	}
+	if _, err := transformfile.OpenFs(fmt.Sprintf("naclfs+file://%s?passphrase=hex:%x", dir+"/ring", "secret")); err == nil {
+		t.Errorf("Passphrase without a config should fail")
+	}
+
+	keys := naclfs.NewKeyring(1, Key("first"))
+	keys.Add(2, Key("second"))
+	fs, err = naclfs.InitKeyring(afero.NewBasePathFs(afero.NewOsFs(), dir+"/ring"), keys, &naclfs.Options{BlockSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	afero.WriteFile(fs, "/old", []byte("first key"), 0644)
+	u := fmt.Sprintf("naclfs+file://%s/ring?keyring=1,2&key1=hex:%x&key2=hex:%x&active=2", dir, Key("first")[:], Key("second")[:])
+	if fs, err = transformfile.OpenFs(u); err != nil {
+		t.Fatal(err)
+	}
+	afero.WriteFile(fs, "/new", []byte("second key"), 0644)
+	for name, want := range map[string]string{"/old": "first key", "/new": "second key"} {
+		if d, err := afero.ReadFile(fs, name); err != nil || string(d) != want {
+			t.Errorf("Unexpected contents of %s %q, %v", name, d, err)
+		}
+	}
+	only := fmt.Sprintf("naclfs+file://%s/ring?keyring=1&key1=hex:%x", dir, Key("first")[:])
+	if fs, err = transformfile.OpenFs(only); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := afero.ReadFile(fs, "/new"); err == nil {
+		t.Errorf("Blocks with a key missing from the keyring should fail")
+	}
+}
@@ -0,0 +1,435 @@
+package transformfile
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/afero"
+	"golang.org/x/text/transform"
+)
+
+/*
+BackingFunc opens the filesystem at the bottom of a stack, like a
+directory of the operating system
+*/
+type BackingFunc func(p *Params) (afero.Fs, error)
+
+/*
+LayerFunc opens a filesystem on top of backing, like a transforming
+filesystem
+*/
+type LayerFunc func(backing afero.Fs, p *Params) (afero.Fs, error)
+
+/*
+ChainFunc opens a filesystem on top of backing that passes blocks through
+a chain of codecs, in the order they are given
+*/
+type ChainFunc func(backing afero.Fs, codecs []Codec, p *Params) (afero.Fs, error)
+
+/*
+Codec is one stage of a chain of block transformations. The transformers
+are created for blocks of up to blockSize bytes of input to the write
+transformer, which grows each block by Overhead bytes. The write
+transformer of a Variable codec, like a compressing one, may produce
+shorter blocks, growing them by at most Overhead bytes. Codecs have to
+handle blocks shorter than blockSize, like the last block of a file.
+*/
+type Codec struct {
+	// Name identifies the codec in file headers
+	Name                string
+	Overhead            int
+	Variable            bool
+	NewReadTransformer  func(blockSize int64) transform.Transformer
+	NewWriteTransformer func(blockSize int64) transform.Transformer
+}
+
+// CodecFunc creates a codec for a chain
+type CodecFunc func(p *Params) (Codec, error)
+
+/*
+KeyFunc resolves the reference of a key, the part of a key parameter after
+the scheme of the key provider, to the key
+*/
+type KeyFunc func(ref string) ([]byte, error)
+
+// SchemeKind is what a registered scheme provides
+type SchemeKind int
+
+const (
+	BackingScheme SchemeKind = iota + 1
+	LayerScheme
+	KeyScheme
+	ChainScheme
+	CodecScheme
+)
+
+func (k SchemeKind) String() string {
+	switch k {
+	case BackingScheme:
+		return "backing"
+	case LayerScheme:
+		return "layer"
+	case KeyScheme:
+		return "key"
+	case ChainScheme:
+		return "chain"
+	case CodecScheme:
+		return "codec"
+	}
+	return fmt.Sprintf("SchemeKind(%d)", int(k))
+}
+
+// Scheme is a registered scheme, as listed by Schemes
+type Scheme struct {
+	Name string
+	Kind SchemeKind
+}
+
+var registry = struct {
+	sync.RWMutex
+	backings map[string]BackingFunc
+	layers   map[string]LayerFunc
+	keys     map[string]KeyFunc
+	chains   map[string]ChainFunc
+	codecs   map[string]CodecFunc
+}{
+	backings: make(map[string]BackingFunc),
+	layers:   make(map[string]LayerFunc),
+	keys:     make(map[string]KeyFunc),
+	chains:   make(map[string]ChainFunc),
+	codecs:   make(map[string]CodecFunc),
+}
+
+func init() {
+	RegisterBacking("file", openFileBacking)
+	RegisterBacking("mem", func(*Params) (afero.Fs, error) {
+		return afero.NewMemMapFs(), nil
+	})
+	RegisterKeyProvider("hex", hex.DecodeString)
+	RegisterKeyProvider("env", func(ref string) ([]byte, error) {
+		value, ok := os.LookupEnv(ref)
+		if !ok {
+			return nil, fmt.Errorf("Environment variable %s is not set", ref)
+		}
+		return hex.DecodeString(strings.TrimSpace(value))
+	})
+	RegisterKeyProvider("file", func(ref string) ([]byte, error) {
+		data, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return nil, err
+		}
+		return hex.DecodeString(strings.TrimSpace(string(data)))
+	})
+}
+
+// Checks a scheme can be registered, URLs are parsed with lower case schemes
+func checkRegister(scheme string, isNil, registered bool) {
+	if scheme == "" || strings.ContainsAny(scheme, "+:") || scheme != strings.ToLower(scheme) {
+		panic(fmt.Sprintf("transformfile: invalid scheme %q", scheme))
+	}
+	if isNil {
+		panic("transformfile: register of nil function for scheme " + scheme)
+	}
+	if registered {
+		panic("transformfile: scheme " + scheme + " registered twice")
+	}
+}
+
+/*
+Returns whether a scheme of a layer, chain or codec is registered, as they
+share the schemes of a URL, registry must be locked
+*/
+func stacked(scheme string) bool {
+	_, layer := registry.layers[scheme]
+	_, chain := registry.chains[scheme]
+	_, codec := registry.codecs[scheme]
+	return layer || chain || codec
+}
+
+/*
+RegisterBacking makes a backing filesystem available to OpenFs by scheme.
+Panics if the scheme is registered twice. The schemes "file" and "mem" are
+registered by this package.
+*/
+func RegisterBacking(scheme string, fn BackingFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	_, ok := registry.backings[scheme]
+	checkRegister(scheme, fn == nil, ok)
+	registry.backings[scheme] = fn
+}
+
+/*
+RegisterLayer makes a filesystem layer available to OpenFs by scheme.
+Panics if the scheme is registered twice. Packages providing layers
+register them when they are imported.
+*/
+func RegisterLayer(scheme string, fn LayerFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	checkRegister(scheme, fn == nil, stacked(scheme))
+	registry.layers[scheme] = fn
+}
+
+/*
+RegisterKeyProvider makes a source of keys available to key parameters by
+scheme. Panics if the scheme is registered twice. The schemes "hex", for
+keys given in the parameter, "env", for keys in environment variables, and
+"file", for keys in files, are registered by this package. All of them
+expect hex encoded keys.
+*/
+func RegisterKeyProvider(scheme string, fn KeyFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	_, ok := registry.keys[scheme]
+	checkRegister(scheme, fn == nil, ok)
+	registry.keys[scheme] = fn
+}
+
+/*
+RegisterChain makes a filesystem layer built from a chain of codecs
+available to OpenFs by scheme. The codecs are given by the codec schemes
+following it in the URL. Panics if the scheme is registered twice.
+*/
+func RegisterChain(scheme string, fn ChainFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	checkRegister(scheme, fn == nil, stacked(scheme))
+	registry.chains[scheme] = fn
+}
+
+/*
+RegisterCodec makes a codec available to chains opened by OpenFs by
+scheme. Panics if the scheme is registered twice.
+*/
+func RegisterCodec(scheme string, fn CodecFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	checkRegister(scheme, fn == nil, stacked(scheme))
+	registry.codecs[scheme] = fn
+}
+
+// Schemes lists the registered schemes, ordered by kind and name
+func Schemes() []Scheme {
+	registry.RLock()
+	defer registry.RUnlock()
+	var list []Scheme
+	for name := range registry.backings {
+		list = append(list, Scheme{name, BackingScheme})
+	}
+	for name := range registry.layers {
+		list = append(list, Scheme{name, LayerScheme})
+	}
+	for name := range registry.keys {
+		list = append(list, Scheme{name, KeyScheme})
+	}
+	for name := range registry.chains {
+		list = append(list, Scheme{name, ChainScheme})
+	}
+	for name := range registry.codecs {
+		list = append(list, Scheme{name, CodecScheme})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+/*
+Params are the parameters of one scheme of a URL passed to OpenFs. Query
+parameters apply to all schemes of the URL, unless they are prefixed with
+the name of a scheme and a dot, like "naclfs.key", which apply to that
+scheme only, or with the position of the scheme in the URL and a dot, like
+"0.key" for the first scheme, which apply to that position only. Parameters
+for a position take precedence over those for a scheme, which take
+precedence over unprefixed ones.
+*/
+type Params struct {
+	// Scheme the parameters are for
+	Scheme string
+	// Position of the scheme in the URL, counting from 0 on the left
+	Index int
+	URL   *url.URL
+}
+
+/*
+Path returns the path of the URL, which locates the backing filesystem.
+Opaque URLs like "file:data" have relative paths.
+*/
+func (p *Params) Path() string {
+	if p.URL.Opaque != "" {
+		return p.URL.Opaque
+	}
+	return p.URL.Path
+}
+
+// Get returns the value of a query parameter, "" if it is not set
+func (p *Params) Get(name string) string {
+	query := p.URL.Query()
+	for _, prefix := range []string{strconv.Itoa(p.Index), p.Scheme} {
+		if v, ok := query[prefix+"."+name]; ok && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return query.Get(name)
+}
+
+// Int returns the value of an integer query parameter, def if it is not set
+func (p *Params) Int(name string, def int64) (int64, error) {
+	v := p.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(v, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid parameter %s=%q of %s", name, v, p.Scheme)
+	}
+	return i, nil
+}
+
+// Bool returns the value of a boolean query parameter, false if it is not set
+func (p *Params) Bool(name string) (bool, error) {
+	v := p.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("Invalid parameter %s=%q of %s", name, v, p.Scheme)
+	}
+	return b, nil
+}
+
+/*
+Key resolves the key a query parameter refers to through the registered
+key providers. The value of the parameter is the scheme of a provider and
+the reference of the key, separated by a colon, like "env:STORE_KEY".
+*/
+func (p *Params) Key(name string) ([]byte, error) {
+	v := p.Get(name)
+	if v == "" {
+		return nil, fmt.Errorf("Missing parameter %s of %s", name, p.Scheme)
+	}
+	i := strings.IndexByte(v, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("Parameter %s of %s does not name a key provider", name, p.Scheme)
+	}
+	registry.RLock()
+	fn, ok := registry.keys[v[:i]]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown key provider %q", v[:i])
+	}
+	key, err := fn(v[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("Resolving key %s of %s failed: %v", name, p.Scheme, err)
+	}
+	return key, nil
+}
+
+/*
+OpenFs builds a stack of filesystems from a URL. The scheme of the URL
+lists layers and the backing at the bottom, separated by "+", so
+
+	naclfs+file:///data?blockSize=65536&key=env:STORE_KEY
+
+opens the naclfs layer on the directory /data. Layers are stacked from
+right to left, each on top of the filesystems to its right, so codecs are
+chained by listing several layers. Parameters of layers with the same
+scheme are told apart by position, like in
+
+	naclfs+naclfs+file:///data?0.key=env:OUTER_KEY&1.key=env:INNER_KEY
+
+A chain is followed by the codecs it passes blocks through, so
+
+	trfs+deflate+secretbox+file:///data?blockSize=65536&key=env:STORE_KEY
+
+opens a single layer compressing and then encrypting blocks. Schemes have
+to be registered, see Schemes for those available.
+*/
+func OpenFs(rawurl string) (afero.Fs, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("Missing scheme in %q", rawurl)
+	}
+	schemes := strings.Split(u.Scheme, "+")
+	last := len(schemes) - 1
+	registry.RLock()
+	open := registry.backings[schemes[last]]
+	layers := make([]LayerFunc, last)
+	chains := make([]ChainFunc, last)
+	codecs := make([]CodecFunc, last)
+	for i, s := range schemes[:last] {
+		layers[i], chains[i], codecs[i] = registry.layers[s], registry.chains[s], registry.codecs[s]
+	}
+	registry.RUnlock()
+	if open == nil {
+		return nil, fmt.Errorf("Unknown scheme %q", schemes[last])
+	}
+	for i, s := range schemes[:last] {
+		if layers[i] == nil && chains[i] == nil && codecs[i] == nil {
+			return nil, fmt.Errorf("Unknown scheme %q", s)
+		}
+		if codecs[i] != nil && (i == 0 || (chains[i-1] == nil && codecs[i-1] == nil)) {
+			return nil, fmt.Errorf("Codec %q does not follow a chain", s)
+		}
+		if chains[i] != nil && (i+1 == last || codecs[i+1] == nil) {
+			return nil, fmt.Errorf("Chain %q is not followed by codecs", s)
+		}
+	}
+	fs, err := open(&Params{schemes[last], last, u})
+	if err != nil {
+		return nil, err
+	}
+	var chained []Codec
+	for i := last - 1; i >= 0; i-- {
+		p := &Params{schemes[i], i, u}
+		switch {
+		case codecs[i] != nil:
+			c, err := codecs[i](p)
+			if err != nil {
+				return nil, err
+			}
+			chained = append([]Codec{c}, chained...)
+		case chains[i] != nil:
+			fs, err = chains[i](fs, chained, p)
+			chained = nil
+		default:
+			fs, err = layers[i](fs, p)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// Opens the directory at the path of the URL, or the whole filesystem without a path
+func openFileBacking(p *Params) (afero.Fs, error) {
+	fs := afero.NewOsFs()
+	if p.Path() == "" {
+		return fs, nil
+	}
+	info, err := fs.Stat(p.Path())
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: p.Path(), Err: syscall.ENOTDIR}
+	}
+	return afero.NewBasePathFs(fs, p.Path()), nil
+}
@@ -0,0 +1,112 @@
+package transformfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// Records the parameters it was opened with in the name
+type nameFs struct {
+	afero.Fs
+	name string
+}
+
+func (fs *nameFs) Name() string {
+	return fs.name
+}
+
+func init() {
+	RegisterLayer("testlayer", func(backing afero.Fs, p *Params) (afero.Fs, error) {
+		key, err := p.Key("key")
+		if err != nil {
+			return nil, err
+		}
+		return &nameFs{backing, fmt.Sprintf("%s(%s,%x)", p.Get("tag"), backing.Name(), key)}, nil
+	})
+	RegisterChain("testchain", func(backing afero.Fs, codecs []Codec, p *Params) (afero.Fs, error) {
+		var names []string
+		for _, c := range codecs {
+			names = append(names, c.Name)
+		}
+		return &nameFs{backing, fmt.Sprintf("chain%v(%s)", names, backing.Name())}, nil
+	})
+	RegisterCodec("testcodec", func(p *Params) (Codec, error) {
+		return Codec{Name: fmt.Sprintf("%s@%d", p.Get("tag"), p.Index)}, nil
+	})
+}
+
+func TestOpenFs(t *testing.T) {
+	os.Setenv("TESTLAYER_KEY", "0102")
+	defer os.Unsetenv("TESTLAYER_KEY")
+
+	fs, err := OpenFs("testlayer+testlayer+mem://?tag=outer&key=env:TESTLAYER_KEY&testlayer.tag=inner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := fs.Name(); name != "inner(inner(MemMapFS,0102),0102)" {
+		t.Errorf("Unexpected stack %s", name)
+	}
+
+	// Parameters for a position take precedence
+	fs, err = OpenFs("testlayer+testlayer+mem://?key=hex:0102&testlayer.tag=inner&0.tag=outer&1.key=hex:0304")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := fs.Name(); name != "outer(inner(MemMapFS,0304),0102)" {
+		t.Errorf("Unexpected stack %s", name)
+	}
+
+	// Codecs following a chain make up a single layer
+	fs, err = OpenFs("testchain+testcodec+testcodec+testlayer+mem://?key=hex:01&tag=x&1.tag=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := fs.Name(); name != "chain[a@1 x@2](x(MemMapFS,01))" {
+		t.Errorf("Unexpected stack %s", name)
+	}
+
+	dir, err := ioutil.TempDir("", "transformfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err = OpenFs("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afero.WriteFile(fs, "/file", []byte("data"), 0644)
+	if _, err := os.Stat(dir + "/file"); err != nil {
+		t.Errorf("File backing is not rooted at the path: %v", err)
+	}
+
+	for _, u := range []string{
+		"unknown+mem://",
+		"testlayer+unknown://",
+		"testlayer+mem://?key=nokey",
+		"testlayer+mem://?key=unknown:ref",
+		"testlayer+mem://?key=env:TESTLAYER_UNSET",
+		"testcodec+mem://",
+		"testchain+mem://",
+		"testchain+testlayer+mem://?key=hex:01",
+		"testlayer+testcodec+mem://?key=hex:01",
+		"file://" + dir + "/file",
+	} {
+		if _, err := OpenFs(u); err == nil {
+			t.Errorf("Expected %s to fail", u)
+		}
+	}
+
+	for _, want := range []Scheme{{"testlayer", LayerScheme}, {"testchain", ChainScheme}, {"testcodec", CodecScheme}} {
+		found := false
+		for _, s := range Schemes() {
+			found = found || s == want
+		}
+		if !found {
+			t.Errorf("%v missing from %v", want, Schemes())
+		}
+	}
+}
@@ -30,6 +30,22 @@ var (
 	errUnsupportedSeekMode = fmt.Errorf("unsupported seek mode")
 )
 
+/*
+BlockError is returned when a block could not be read or decoded
+*/
+type BlockError struct {
+	Block int64
+	Err   error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("Error reading block %d: %v", e.Block, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
 /*
 NewReadWriteSeeker takes transforming readers and writers and wraps around a seeker
 
@@ -77,10 +93,25 @@ func (f *rws) Write(p []byte) (n int, err error) {
 			return n, errors.Wrap(err, "Error reading next block")
 		}
 		_, blockOffset := f.position()
-		if blockOffset < 0 || blockOffset > int64(len(f.currentBlock)) {
-			// TODO
+		if blockOffset < 0 {
 			return n, fmt.Errorf("Invalid offset %d", blockOffset)
 		}
+		if f.atEOF && blockOffset >= int64(len(f.currentBlock)) {
+			// Writing past the end of file must not leave holes. The loaded
+			// block may be short because the backing file grew after it was
+			// loaded, through another handle sharing it, so the gap is
+			// checked against the current size.
+			end, err := f.size()
+			if err != nil {
+				return n, err
+			}
+			if f.index > end {
+				if err = f.fill(f.index); err != nil {
+					return n, errors.Wrap(err, "Error filling gap")
+				}
+				continue
+			}
+		}
 		b, copied := mergeBlocks(f.currentBlock, p[n:], blockOffset, f.blockSize)
 		n += copied
 		f.index += int64(copied)
@@ -96,10 +127,17 @@ func (f *rws) Write(p []byte) (n int, err error) {
 func (f *rws) Read(p []byte) (n int, err error) {
 	for len(p)-n > 0 && err == nil {
 		err = f.loadBlock()
+		if err != nil {
+			return n, err
+		}
 		_, blockOffset := f.position()
-		if blockOffset < 0 || blockOffset > int64(len(f.currentBlock)) {
+		if blockOffset < 0 {
 			return n, ErrInvalidSeek
 		}
+		if blockOffset > int64(len(f.currentBlock)) {
+			// Reading past the end of file
+			return n, io.EOF
+		}
 		copied := copy(p[n:], f.currentBlock[blockOffset:])
 		n += copied
 		f.index += int64(copied)
@@ -147,12 +185,46 @@ func (f *rws) loadBlock() error {
 	f.currentBlock = b[:n]
 	f.currentBlockIdx = blockIdx
 
+	// Some backings, like afero.MemMapFs, fail reads past the end of file
+	if err == io.ErrUnexpectedEOF && n == 0 {
+		err = io.EOF
+	}
+
 	if err == io.EOF {
 		f.atEOF = true
 	} else {
 		f.atEOF = false
 		if err != nil {
-			return errors.Wrap(err, "Error reading block")
+			return &BlockError{blockIdx, err}
+		}
+	}
+	return nil
+}
+
+// Returns the size of the data
+func (f *rws) size() (int64, error) {
+	end, err := f.Seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return f.removeOverhead(end), nil
+}
+
+/*
+Extends the data with zeros up to the given size, leaving the index at the
+end. Blocks are written one at a time, there are no holes in the backing
+file.
+*/
+func (f *rws) fill(size int64) error {
+	end, err := f.size()
+	if err != nil {
+		return err
+	}
+	f.index = end
+	zeros := make([]byte, f.blockSize)
+	for f.index < size {
+		if _, err := f.Write(zeros[:min(size-f.index, f.blockSize)]); err != nil {
+			return err
 		}
 	}
 	return nil
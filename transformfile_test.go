@@ -311,6 +311,33 @@ func TestWriteFile(t *testing.T) {
 	}
 }
 
+// Writing past the end fills the gap with zeros
+func TestWritePastEnd(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "test", []byte("HHeelllloo  WWoorrlldd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.OpenFile("test", os.O_RDWR, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewReadWriteSeeker(1, 1, file, NewHalfReader(file), NewDoubleWriter(file))
+	if _, err := tr.Seek(13, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tr.Write([]byte("!")); err != nil || n != 1 {
+		t.Fatalf("Unexpected write result %d, %v", n, err)
+	}
+	tr.Seek(0, io.SeekStart)
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Hello World\x00\x00!" {
+		t.Errorf("Unexpected result %q", data)
+	}
+}
+
 var seekTests = []struct {
 	startOffset    int64
 	len            int64
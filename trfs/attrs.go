@@ -0,0 +1,207 @@
+package trfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/tobiash/go-transformfile"
+)
+
+/*
+Attributer is implemented by filesystems that can attach small named
+values, like a content type or tags, to files and directories
+*/
+type Attributer interface {
+	// SetAttr sets an attribute of the named file, replacing any previous value
+	SetAttr(name, key string, value []byte) error
+	// GetAttr returns an attribute of the named file
+	GetAttr(name, key string) ([]byte, error)
+	// ListAttrs lists the attribute keys of the named file in sorted order
+	ListAttrs(name string) ([]string, error)
+	// RemoveAttr deletes an attribute of the named file
+	RemoveAttr(name, key string) error
+}
+
+var _ Attributer = (*trfs)(nil)
+
+var (
+	/* ErrNoAttr is returned when the requested attribute does not exist */
+	ErrNoAttr         = fmt.Errorf("attribute not found")
+	errInvalidAttrKey = fmt.Errorf("invalid attribute key")
+)
+
+const attrPrefix = internalPrefix + "attr."
+
+/*
+Attributes are kept in a sidecar file next to the file they belong to.
+The sidecar holds a JSON object mapping keys to values and is always
+transformed, even if the file itself is excluded by the rules.
+*/
+func (fs *trfs) attrName(path string) string {
+	return fs.sidecarName(path, attrPrefix)
+}
+
+// Reads the attributes of the backing file at path, fs.mu must be held
+func (fs *trfs) readAttrs(path string) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	f, err := fs.Fs.Open(fs.attrName(path))
+	if os.IsNotExist(err) {
+		return attrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(transformfile.NewFromTransformer(
+		fs.blockSize,
+		fs.overhead,
+		f,
+		true,
+		fs.createReadTransformer(),
+		fs.createWriteTransformer(),
+	))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return nil, fmt.Errorf("Invalid attributes of %s: %v", path, err)
+	}
+	return attrs, nil
+}
+
+/*
+Replaces the attributes of the backing file at path, fs.mu must be held.
+The attributes are written to a temporary sidecar that is renamed over the
+old one, so a crash never leaves partially written attributes behind.
+*/
+func (fs *trfs) writeAttrs(path string, attrs map[string][]byte) error {
+	name := fs.attrName(path)
+	if len(attrs) == 0 {
+		return fs.removeSidecar(name)
+	}
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".new"
+	f, err := fs.Fs.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	tf := transformfile.NewFromTransformer(
+		fs.blockSize,
+		fs.overhead,
+		f,
+		false,
+		fs.createReadTransformer(),
+		fs.createWriteTransformer(),
+	)
+	_, err = tf.Write(data)
+	if err == nil {
+		err = tf.Sync()
+	}
+	if closeErr := tf.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fs.Fs.Rename(tmp, name)
+	}
+	if err != nil {
+		fs.Fs.Remove(tmp)
+	}
+	return err
+}
+
+// Translates name to its backing path and checks the file exists
+func (fs *trfs) attrPath(op, name string) (string, error) {
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return "", &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if _, err := fs.lstat(path); err != nil {
+		return "", pathError(err, name)
+	}
+	return path, nil
+}
+
+func (fs *trfs) SetAttr(name, key string, value []byte) error {
+	if key == "" {
+		return &os.PathError{Op: "setattr", Path: name, Err: errInvalidAttrKey}
+	}
+	if err := fs.checkWritable("setattr", name); err != nil {
+		return err
+	}
+	path, err := fs.attrPath("setattr", name)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	attrs, err := fs.readAttrs(path)
+	if err != nil {
+		return err
+	}
+	attrs[key] = append([]byte(nil), value...)
+	return fs.writeAttrs(path, attrs)
+}
+
+func (fs *trfs) GetAttr(name, key string) ([]byte, error) {
+	path, err := fs.attrPath("getattr", name)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	attrs, err := fs.readAttrs(path)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := attrs[key]
+	if !ok {
+		return nil, &os.PathError{Op: "getattr", Path: name, Err: ErrNoAttr}
+	}
+	return value, nil
+}
+
+func (fs *trfs) ListAttrs(name string) ([]string, error) {
+	path, err := fs.attrPath("listattrs", name)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	attrs, err := fs.readAttrs(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (fs *trfs) RemoveAttr(name, key string) error {
+	if err := fs.checkWritable("removeattr", name); err != nil {
+		return err
+	}
+	path, err := fs.attrPath("removeattr", name)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	attrs, err := fs.readAttrs(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := attrs[key]; !ok {
+		return &os.PathError{Op: "removeattr", Path: name, Err: ErrNoAttr}
+	}
+	delete(attrs, key)
+	return fs.writeAttrs(path, attrs)
+}
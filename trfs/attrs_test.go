@@ -0,0 +1,103 @@
+package trfs_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func TestAttrs(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs := naclfs.New(16, Key("attrs"), backing)
+	attrs := fs.(trfs.Attributer)
+
+	afero.WriteFile(fs, "/file", []byte("content"), 0644)
+	if err := attrs.SetAttr("/file", "content-type", []byte("text/plain")); err != nil {
+		t.Fatal(err)
+	}
+	attrs.SetAttr("/file", "owner", []byte("someone"))
+	if err := attrs.SetAttr("/missing", "owner", nil); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+
+	for _, n := range backingNames(t, backing) {
+		data, _ := afero.ReadFile(backing, n)
+		if bytes.Contains(data, []byte("text/plain")) {
+			t.Errorf("Backing file %s contains plaintext attribute", n)
+		}
+	}
+
+	if err := fs.Rename("/file", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	value, err := attrs.GetAttr("/moved", "content-type")
+	if err != nil || string(value) != "text/plain" {
+		t.Errorf("Unexpected attribute after rename %q, %v", value, err)
+	}
+	keys, err := attrs.ListAttrs("/moved")
+	if err != nil || strings.Join(keys, ",") != "content-type,owner" {
+		t.Errorf("Unexpected attribute keys %v, %v", keys, err)
+	}
+
+	if err := attrs.RemoveAttr("/moved", "owner"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := attrs.GetAttr("/moved", "owner"); err == nil || err.(*os.PathError).Err != trfs.ErrNoAttr {
+		t.Errorf("Expected ErrNoAttr, got %v", err)
+	}
+
+	if err := fs.Remove("/moved"); err != nil {
+		t.Fatal(err)
+	}
+	afero.WriteFile(fs, "/moved", []byte("new"), 0644)
+	if keys, _ := attrs.ListAttrs("/moved"); len(keys) != 0 {
+		t.Errorf("Attributes survived removal: %v", keys)
+	}
+}
+
+func TestAttrsRemoveAll(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs := naclfs.New(16, Key("attrs"), backing)
+	attrs := fs.(trfs.Attributer)
+
+	fs.MkdirAll("/dir/sub", 0755)
+	afero.WriteFile(fs, "/dir/sub/file", []byte("content"), 0644)
+	attrs.SetAttr("/dir", "tag", []byte("a"))
+	attrs.SetAttr("/dir/sub/file", "tag", []byte("b"))
+
+	if err := fs.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range backingNames(t, backing) {
+		if strings.Contains(n, ".trfs.attr.") {
+			t.Errorf("Attribute sidecar %s survived RemoveAll", n)
+		}
+	}
+}
+
+func TestAttrsInterruptedWrite(t *testing.T) {
+	backing := &failingRenameFs{Fs: afero.NewMemMapFs(), renames: 1}
+	fs := naclfs.New(16, Key("attrs"), backing)
+	attrs := fs.(trfs.Attributer)
+
+	afero.WriteFile(fs, "/file", []byte("content"), 0644)
+	if err := attrs.SetAttr("/file", "tag", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := attrs.SetAttr("/file", "tag", []byte("new")); err == nil {
+		t.Fatalf("Writing attributes should have failed")
+	}
+	if value, err := attrs.GetAttr("/file", "tag"); err != nil || string(value) != "old" {
+		t.Errorf("Unexpected attribute after interrupted write %q, %v", value, err)
+	}
+	for _, n := range backingNames(t, backing) {
+		if strings.HasSuffix(n, ".new") {
+			t.Errorf("Temporary attribute sidecar %s was left behind", n)
+		}
+	}
+}
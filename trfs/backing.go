@@ -0,0 +1,74 @@
+package trfs
+
+import (
+	"io"
+	"math"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+/*
+Wraps a backing file to keep snapshots and parity in sync with the
+blocks written to it
+*/
+type backingFile struct {
+	afero.File
+	fs   *trfs
+	name string
+	// Writes go to the end of the file, wherever the offset is
+	append bool
+}
+
+func (f *backingFile) Write(p []byte) (int, error) {
+	off, err := f.File.Seek(0, io.SeekCurrent)
+	if f.append && err == nil {
+		var info os.FileInfo
+		if info, err = f.File.Stat(); err == nil {
+			off = info.Size()
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	done, err := f.fs.beginModify(f.name, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.File.Write(p)
+	done()
+	if err != nil {
+		return n, err
+	}
+	return n, f.fs.updateParity(f.name, off, int64(n))
+}
+
+func (f *backingFile) WriteAt(p []byte, off int64) (int, error) {
+	done, err := f.fs.beginModify(f.name, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.File.WriteAt(p, off)
+	done()
+	if err != nil {
+		return n, err
+	}
+	return n, f.fs.updateParity(f.name, off, int64(n))
+}
+
+func (f *backingFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *backingFile) Truncate(size int64) error {
+	done, err := f.fs.beginModify(f.name, size, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	err = f.File.Truncate(size)
+	done()
+	if err != nil {
+		return err
+	}
+	return f.fs.truncateParity(f.name, size)
+}
@@ -0,0 +1,150 @@
+package trfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Progress of converting the files of a tree in place. The checkpoint is a
+log of lines, each naming a step and the backing path it applies to:
+"begin" is recorded before the converted copy replaces a file, "done"
+once it has, and "complete" once all files have been converted.
+*/
+type checkpoint struct {
+	// Backing path of the log
+	path string
+	mu   sync.Mutex
+	// Bytes of the log that have been read
+	read     int64
+	done     map[string]bool
+	begun    map[string]bool
+	complete bool
+}
+
+func newCheckpoint(path string) *checkpoint {
+	return &checkpoint{
+		path:  path,
+		done:  make(map[string]bool),
+		begun: make(map[string]bool),
+	}
+}
+
+/*
+Reads steps recorded since the log was last read, c.mu must be held. A
+log that shrank has been replaced and is read again from the start.
+*/
+func (c *checkpoint) refresh(fs *trfs) error {
+	info, err := fs.Fs.Stat(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < c.read {
+		c.read, c.complete = 0, false
+		c.done, c.begun = make(map[string]bool), make(map[string]bool)
+	}
+	if info.Size() == c.read {
+		return nil
+	}
+	f, err := fs.Fs.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := make([]byte, info.Size()-c.read)
+	n, err := f.ReadAt(data, c.read)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	// A step is only recorded once its line is complete
+	data = data[:bytes.LastIndexByte(data[:n], '\n')+1]
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	for lines.Scan() {
+		step := strings.SplitN(lines.Text(), " ", 2)
+		var path string
+		if len(step) == 2 {
+			if path, err = strconv.Unquote(step[1]); err != nil {
+				return fmt.Errorf("Invalid checkpoint %s: %v", c.path, err)
+			}
+		}
+		switch step[0] {
+		case "begin":
+			c.begun[path] = true
+		case "done":
+			delete(c.begun, path)
+			c.done[path] = true
+		case "complete":
+			c.complete = true
+		default:
+			return fmt.Errorf("Invalid step %q in checkpoint %s", step[0], c.path)
+		}
+	}
+	c.read += int64(len(data))
+	return nil
+}
+
+/*
+Reports whether the file at the backing path has been converted. Until the
+conversion is complete, the log is checked for new steps on every call, so
+steps recorded by other filesystems and processes are seen.
+*/
+func (c *checkpoint) converted(fs *trfs, path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.complete {
+		return true
+	}
+	if err := c.refresh(fs); err != nil {
+		// Unreadable progress must not expose converted files as unconverted
+		return true
+	}
+	return c.complete || c.done[path]
+}
+
+// Appends a step to the log
+func (c *checkpoint) record(fs *trfs, step, path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := fs.Fs.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	line := step
+	if path != "" {
+		line += " " + strconv.Quote(path)
+	}
+	_, err = f.Write([]byte(line + "\n"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return c.refresh(fs)
+}
+
+// Returns whether the conversion is complete and the files it had begun
+func (c *checkpoint) state(fs *trfs) (bool, []string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.refresh(fs); err != nil {
+		return false, nil, err
+	}
+	var begun []string
+	for path := range c.begun {
+		begun = append(begun, path)
+	}
+	return c.complete, begun, nil
+}
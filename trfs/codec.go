@@ -0,0 +1,383 @@
+package trfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile"
+	"golang.org/x/text/transform"
+)
+
+/*
+Codec is one stage of a chain of block transformations, see
+transformfile.Codec
+*/
+type Codec = transformfile.Codec
+
+const chainMagic = 0x54524332 // "TRC2"
+
+/*
+Blocks of chains with variable codecs end with the length of the data at
+their start, as blocks are located by their size
+*/
+const frameTrailerSize = 4
+
+var errChainMismatch = fmt.Errorf("file was written with a different codec chain")
+
+/*
+NewChainFs creates a filesystem that passes each block through the codecs
+in order when writing, and in reverse order when reading, so a compressing
+codec is listed before an encrypting one. The overheads of the codecs add
+up. If a codec is variable, blocks keep their size, but only the data at
+their start and its length at their end are written, so the unused space
+in between stays a hole in sparse backing files. The length of the data
+is not transformed and reveals the compressed size of blocks. Each
+transformed file starts with a header recording the block size and the
+chain, files written with a different block size or chain can not be
+opened. Panics if a codec name is empty or longer than 255 bytes.
+*/
+func NewChainFs(
+	blockSize int64,
+	name string,
+	backing afero.Fs,
+	codecs []Codec,
+	opts ...Option) afero.Fs {
+	var (
+		overhead int
+		variable bool
+		readTrs  []func() transform.Transformer
+		writeTrs []func() transform.Transformer
+	)
+	header := new(bytes.Buffer)
+	binary.Write(header, binary.BigEndian, uint32(chainMagic))
+	binary.Write(header, binary.BigEndian, uint64(blockSize))
+	header.WriteByte(byte(len(codecs)))
+	for _, c := range codecs {
+		if len(c.Name) == 0 || len(c.Name) > 255 {
+			panic(fmt.Sprintf("invalid codec name %q", c.Name))
+		}
+		header.WriteByte(byte(len(c.Name)))
+		header.WriteString(c.Name)
+
+		c, size := c, blockSize+int64(overhead)
+		readTrs = append([]func() transform.Transformer{func() transform.Transformer {
+			return c.NewReadTransformer(size)
+		}}, readTrs...)
+		writeTrs = append(writeTrs, func() transform.Transformer {
+			return c.NewWriteTransformer(size)
+		})
+		overhead += c.Overhead
+		variable = variable || c.Variable
+	}
+	readTr, writeTr := newChain(readTrs), newChain(writeTrs)
+	if variable {
+		chainOverhead := overhead
+		readTr = func() transform.Transformer {
+			return &unframer{newChain(readTrs)()}
+		}
+		writeTr = func() transform.Transformer {
+			return &framer{newChain(writeTrs)(), chainOverhead + frameTrailerSize}
+		}
+		overhead += frameTrailerSize
+	}
+	opts = append([]Option{func(fs *trfs) {
+		fs.header = header.Bytes()
+		fs.framed = variable
+	}}, opts...)
+	return NewTransformFileFs(
+		blockSize,
+		overhead,
+		name,
+		backing,
+		readTr,
+		writeTr,
+		opts...,
+	)
+}
+
+func newChain(stages []func() transform.Transformer) func() transform.Transformer {
+	return func() transform.Transformer {
+		c := make(chain, len(stages))
+		for i, s := range stages {
+			c[i] = s()
+		}
+		return c
+	}
+}
+
+/*
+Applies transformers one after another. Like the transformers of the
+codecs, it only handles whole blocks.
+*/
+type chain []transform.Transformer
+
+func (c chain) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !atEOF {
+		return 0, 0, transform.ErrShortSrc
+	}
+	b := src
+	for _, t := range c {
+		if b, _, err = transform.Bytes(t, b); err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(b) > len(dst) {
+		return 0, 0, transform.ErrShortDst
+	}
+	return copy(dst, b), len(src), nil
+}
+
+func (c chain) Reset() {
+	for _, t := range c {
+		t.Reset()
+	}
+}
+
+var (
+	errFrameOverflow = fmt.Errorf("codec grew block by more than its overhead")
+	errInvalidFrame  = fmt.Errorf("invalid length of variable codec block")
+)
+
+/*
+Pads the blocks of a chain with variable codecs to the input size plus the
+overhead of the chain, and appends the length of the data
+*/
+type framer struct {
+	transform.Transformer
+	overhead int
+}
+
+func (f *framer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !atEOF {
+		return 0, 0, transform.ErrShortSrc
+	}
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+	b, _, err := transform.Bytes(f.Transformer, src)
+	if err != nil {
+		return 0, 0, err
+	}
+	n := len(src) + f.overhead
+	if len(b)+frameTrailerSize > n {
+		return 0, 0, errFrameOverflow
+	}
+	if len(dst) < n {
+		return 0, 0, transform.ErrShortDst
+	}
+	copy(dst, b)
+	for i := len(b); i < n-frameTrailerSize; i++ {
+		dst[i] = 0
+	}
+	binary.BigEndian.PutUint32(dst[n-frameTrailerSize:], uint32(len(b)))
+	return n, len(src), nil
+}
+
+// Strips the padding and length from blocks of a chain with variable codecs
+type unframer struct {
+	transform.Transformer
+}
+
+func (f *unframer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !atEOF {
+		return 0, 0, transform.ErrShortSrc
+	}
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+	n, ok := frameLength(src)
+	if !ok {
+		return 0, 0, errInvalidFrame
+	}
+	b, _, err := transform.Bytes(f.Transformer, src[:n])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(b) > len(dst) {
+		return 0, 0, transform.ErrShortDst
+	}
+	return copy(dst, b), len(src), nil
+}
+
+// Returns the length of the data in a framed block
+func frameLength(block []byte) (int, bool) {
+	if len(block) < frameTrailerSize {
+		return 0, false
+	}
+	n := int64(binary.BigEndian.Uint32(block[len(block)-frameTrailerSize:]))
+	if n > int64(len(block)-frameTrailerSize) {
+		return 0, false
+	}
+	return int(n), true
+}
+
+/*
+Writes framed blocks without the padding between their data and their
+length, leaving holes in sparse files. Blocks are written as a whole by
+the transformed file.
+*/
+type framedFile struct {
+	afero.File
+}
+
+func (f *framedFile) Write(p []byte) (int, error) {
+	n, ok := frameLength(p)
+	if !ok || n+frameTrailerSize == len(p) {
+		return f.File.Write(p)
+	}
+	off, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// Growing the file by truncating leaves the padding unallocated
+	if end := off + int64(len(p)); info.Size() < end {
+		if err := f.File.Truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := f.File.WriteAt(p[:n], off); err != nil {
+		return 0, err
+	}
+	trailer := off + int64(len(p)-frameTrailerSize)
+	if _, err := f.File.WriteAt(p[len(p)-frameTrailerSize:], trailer); err != nil {
+		return 0, err
+	}
+	if _, err := f.File.Seek(off+int64(len(p)), io.SeekStart); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/*
+Returns the size of the header at the start of the backing file, 0 if it
+has none. Files that are not transformed never start with a header.
+*/
+func (fs *trfs) dataOffset(f afero.File) (int64, error) {
+	if fs.header == nil {
+		return 0, nil
+	}
+	h := make([]byte, len(fs.header))
+	n, err := f.ReadAt(h, 0)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if n == len(h) && bytes.Equal(h, fs.header) {
+		return int64(n), nil
+	}
+	return 0, nil
+}
+
+/*
+Prepares the backing file of a transformed file for use. New files get a
+header, existing files have to start with the header of the chain.
+*/
+func (fs *trfs) openData(f afero.File, writable bool) (afero.File, error) {
+	if fs.header == nil {
+		return f, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		if !writable {
+			return f, nil
+		}
+		if _, err := f.WriteAt(fs.header, 0); err != nil {
+			return nil, err
+		}
+	}
+	off, err := fs.dataOffset(f)
+	if err != nil {
+		return nil, err
+	}
+	if off == 0 {
+		return nil, errChainMismatch
+	}
+	data, err := newOffsetFile(f, off)
+	if err != nil || !fs.framed {
+		return data, err
+	}
+	return &framedFile{data}, nil
+}
+
+/*
+Opens a backing file for internal use, skipping its header if it has
+one
+*/
+func (fs *trfs) openDataFile(path string, flag int) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	off, err := fs.dataOffset(f)
+	if err == nil && off > 0 {
+		var data afero.File
+		if data, err = newOffsetFile(f, off); err == nil {
+			return data, nil
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Hides the first bytes of a file
+type offsetFile struct {
+	afero.File
+	offset int64
+}
+
+type offsetFileInfo struct {
+	os.FileInfo
+	offset int64
+}
+
+func (i *offsetFileInfo) Size() int64 {
+	return max(i.FileInfo.Size()-i.offset, 0)
+}
+
+func newOffsetFile(f afero.File, offset int64) (afero.File, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &offsetFile{f, offset}, nil
+}
+
+func (f *offsetFile) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += f.offset
+	}
+	n, err := f.File.Seek(offset, whence)
+	return n - f.offset, err
+}
+
+func (f *offsetFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.File.ReadAt(p, off+f.offset)
+}
+
+func (f *offsetFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.File.WriteAt(p, off+f.offset)
+}
+
+func (f *offsetFile) Truncate(size int64) error {
+	return f.File.Truncate(size + f.offset)
+}
+
+func (f *offsetFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if info != nil {
+		info = &offsetFileInfo{info, f.offset}
+	}
+	return info, err
+}
@@ -0,0 +1,232 @@
+package trfs_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+	"golang.org/x/text/transform"
+)
+
+// Appends a checksum to each block
+type crcEncoder struct{ transform.NopResetter }
+
+type crcDecoder struct{ transform.NopResetter }
+
+func (crcEncoder) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	if len(dst) < len(src)+4 {
+		return 0, 0, transform.ErrShortDst
+	}
+	n := copy(dst, src)
+	binary.BigEndian.PutUint32(dst[n:], crc32.ChecksumIEEE(src))
+	return n + 4, len(src), nil
+}
+
+func (crcDecoder) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+	if len(src) < 4 {
+		return 0, 0, fmt.Errorf("short block")
+	}
+	data := src[:len(src)-4]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(src[len(data):]) {
+		return 0, 0, fmt.Errorf("checksum mismatch")
+	}
+	if len(dst) < len(data) {
+		return 0, 0, transform.ErrShortDst
+	}
+	return copy(dst, data), len(src), nil
+}
+
+var crcCodec = trfs.Codec{
+	Name:     "crc32",
+	Overhead: 4,
+	NewReadTransformer: func(int64) transform.Transformer {
+		return crcDecoder{}
+	},
+	NewWriteTransformer: func(int64) transform.Transformer {
+		return crcEncoder{}
+	},
+}
+
+func TestChainFs(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	codecs := []trfs.Codec{crcCodec, naclfs.NewCodec(Key("chain"))}
+	fs := trfs.NewChainFs(16, "chain", backing, codecs)
+
+	data := bytes.Repeat([]byte("chained data "), 10)
+	if err := afero.WriteFile(fs, "/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	read, err := afero.ReadFile(fs, "/file")
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("Unexpected contents %q, %v", read, err)
+	}
+	info, err := fs.Stat("/file")
+	if err != nil || info.Size() != int64(len(data)) {
+		t.Errorf("Unexpected size %v, %v", info, err)
+	}
+
+	raw, _ := afero.ReadFile(backing, "/file")
+	if !bytes.Contains(raw[:48], []byte("crc32")) || !bytes.Contains(raw[:48], []byte(naclfs.Codec)) {
+		t.Errorf("Codec chain missing from file header")
+	}
+	blocks := (len(data) + 15) / 16
+	overhead := 4 + naclfs.NewCodec(Key("chain")).Overhead
+	if len(raw) <= len(data)+blocks*overhead || len(raw) > len(data)+blocks*overhead+48 {
+		t.Errorf("Unexpected backing size %d", len(raw))
+	}
+
+	other := trfs.NewChainFs(16, "chain", backing, codecs[1:])
+	if _, err := other.Open("/file"); err == nil {
+		t.Errorf("Opening a file written with a different chain should fail")
+	}
+}
+
+func TestChainFsSidecars(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs := trfs.NewChainFs(16, "chain", backing, []trfs.Codec{crcCodec}, trfs.WithParity(2, 1))
+	afero.WriteFile(fs, "/file", []byte("0123456789abcdefghijklmnopqrstuvwxyz"), 0644)
+	id, err := fs.(trfs.Snapshotter).Snapshot("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("XX"), 20)
+	if err := f.Truncate(24); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if d, _ := afero.ReadFile(fs, "/file"); string(d) != "0123456789abcdefghijXXmn" {
+		t.Errorf("Unexpected contents %q", d)
+	}
+	// Damage the checksum of the last block, parity is kept relative to the header
+	raw, _ := afero.ReadFile(backing, "/file")
+	raw[len(raw)-1] ^= 0xff
+	afero.WriteFile(backing, "/file", raw, 0644)
+	if d, err := afero.ReadFile(fs, "/file"); err != nil || string(d) != "0123456789abcdefghijXXmn" {
+		t.Errorf("Unexpected contents after repair %q, %v", d, err)
+	}
+	if s := readSnapshot(t, fs.(trfs.Snapshotter), "/file", id); s != "0123456789abcdefghijklmnopqrstuvwxyz" {
+		t.Errorf("Unexpected snapshot contents %q", s)
+	}
+}
+
+// Counts the bytes written to files
+type byteCountingFs struct {
+	afero.Fs
+	written int64
+}
+
+type byteCountingFile struct {
+	afero.File
+	fs *byteCountingFs
+}
+
+func (fs *byteCountingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &byteCountingFile{f, fs}, nil
+}
+
+func (f *byteCountingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.fs.written += int64(n)
+	return n, err
+}
+
+func (f *byteCountingFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	f.fs.written += int64(n)
+	return n, err
+}
+
+func TestChainFsDeflate(t *testing.T) {
+	backing := &byteCountingFs{Fs: afero.NewMemMapFs()}
+	codecs := []trfs.Codec{trfs.DeflateCodec(flate.BestCompression), naclfs.NewCodec(Key("chain"))}
+	fs := trfs.NewChainFs(64, "chain", backing, codecs)
+
+	random := make([]byte, 100)
+	rand.Read(random)
+	files := map[string][]byte{
+		"/compressible": bytes.Repeat([]byte("a"), 150),
+		"/random":       random,
+	}
+	overhead := 1 + 4 + naclfs.NewCodec(Key("chain")).Overhead
+	var headerSize int
+	for name, data := range files {
+		if err := afero.WriteFile(fs, name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if read, err := afero.ReadFile(fs, name); err != nil || !bytes.Equal(read, data) {
+			t.Errorf("%s: unexpected contents %q, %v", name, read, err)
+		}
+		if info, err := fs.Stat(name); err != nil || info.Size() != int64(len(data)) {
+			t.Errorf("%s: unexpected size %v, %v", name, info, err)
+		}
+		// Blocks keep their full size
+		info, _ := backing.Stat(name)
+		blocks := (len(data) + 63) / 64
+		if headerSize == 0 {
+			headerSize = int(info.Size()) - len(data) - blocks*overhead
+		}
+		if info.Size() != int64(headerSize+len(data)+blocks*overhead) {
+			t.Errorf("%s: unexpected backing size %d", name, info.Size())
+		}
+	}
+
+	// Only the compressed data is written, the padding stays a hole
+	backing.written = 0
+	data := bytes.Repeat([]byte("a"), 64*16)
+	if err := afero.WriteFile(fs, "/sparse", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(fs, "/sparse"); err != nil || !bytes.Equal(d, data) {
+		t.Errorf("Unexpected contents of sparse file %q, %v", d, err)
+	}
+	if backing.written >= int64(len(data)) {
+		t.Errorf("Expected compressed blocks to save space, wrote %d bytes", backing.written)
+	}
+
+	other := trfs.NewChainFs(32, "chain", backing, codecs)
+	if _, err := other.Open("/compressible"); err == nil {
+		t.Errorf("Opening a file written with a different block size should fail")
+	}
+}
+
+func TestDeflateCodec(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs := trfs.NewChainFs(64, "deflate", backing, []trfs.Codec{trfs.DeflateCodec(flate.BestCompression)})
+	data := bytes.Repeat([]byte("a"), 64)
+	if err := afero.WriteFile(fs, "/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := afero.ReadFile(backing, "/file")
+	block := raw[len(raw)-(64+1+4):]
+	if n := binary.BigEndian.Uint32(block[len(block)-4:]); n == 0 || n >= 64 {
+		t.Errorf("Expected a compressed block, got length %d", n)
+	}
+	if bytes.Contains(raw, data[:16]) {
+		t.Errorf("Backing file contains uncompressed data")
+	}
+	// Corrupt the compressed data
+	block[2] ^= 0xff
+	afero.WriteFile(backing, "/file", raw, 0644)
+	if d, err := afero.ReadFile(fs, "/file"); err == nil && bytes.Equal(d, data) {
+		t.Errorf("Reading corrupted data should fail")
+	}
+}
@@ -0,0 +1,160 @@
+package trfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+/*
+ConfigName is the name of the file at the root of the backing filesystem
+that records the parameters a tree was created with
+*/
+const ConfigName = internalPrefix + "json"
+
+// ConfigVersion is the version of the config format written by WriteConfig
+const ConfigVersion = 1
+
+var (
+	/* ErrConfigExists is returned when initialising an already initialised tree */
+	ErrConfigExists = fmt.Errorf("filesystem config exists already")
+	/* ErrNoConfig is returned when opening a tree without config */
+	ErrNoConfig = fmt.Errorf("filesystem config not found")
+)
+
+/*
+Config holds the parameters a transformed tree was created with
+*/
+type Config struct {
+	Version   int    `json:"version"`
+	BlockSize int64  `json:"blockSize"`
+	Overhead  int    `json:"overhead"`
+	Codec     string `json:"codec"`
+	// MaxNameLength is 0 if names are not encrypted
+	MaxNameLength int `json:"maxNameLength,omitempty"`
+	// KeyVerifier allows checking a key before decrypting data with it
+	KeyVerifier []byte `json:"keyVerifier,omitempty"`
+	// KeyVerifiers are the verifiers of the keys of a keyring by ID
+	KeyVerifiers map[uint32][]byte `json:"keyVerifiers,omitempty"`
+	// KDF is set if the key is protected by a passphrase
+	KDF *KDFParams `json:"kdf,omitempty"`
+	// WrappedKey is the key encrypted with the key derived by KDF
+	WrappedKey []byte `json:"wrappedKey,omitempty"`
+	// PreviousWrappedKey is the key a rekey replaces, wrapped like WrappedKey until it completes
+	PreviousWrappedKey []byte `json:"previousWrappedKey,omitempty"`
+}
+
+// Key derivation functions of KDFParams
+const (
+	KDFScrypt   = "scrypt"
+	KDFArgon2id = "argon2id"
+)
+
+/*
+KDFParams are the parameters of deriving a key from a passphrase. Only the
+cost parameters of the algorithm are used.
+*/
+type KDFParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	// Cost of scrypt
+	N int `json:"n,omitempty"`
+	R int `json:"r,omitempty"`
+	P int `json:"p,omitempty"`
+	// Cost of Argon2id, Memory is in KiB
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+}
+
+/*
+WriteConfig stores the config at the root of the backing filesystem.
+An existing config is never overwritten.
+*/
+func WriteConfig(backing afero.Fs, cfg *Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Not all backing filesystems honour O_EXCL
+	if _, err := backing.Stat(ConfigName); err == nil {
+		return ErrConfigExists
+	}
+	f, err := backing.OpenFile(ConfigName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0444)
+	if os.IsExist(err) {
+		return ErrConfigExists
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		backing.Remove(ConfigName)
+	}
+	return err
+}
+
+/*
+ReadConfig reads the config from the root of the backing filesystem
+*/
+func ReadConfig(backing afero.Fs) (*Config, error) {
+	data, err := afero.ReadFile(backing, ConfigName)
+	if os.IsNotExist(err) {
+		return nil, ErrNoConfig
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("Invalid filesystem config: %v", err)
+	}
+	if cfg.Version != ConfigVersion {
+		return nil, fmt.Errorf("Unsupported filesystem config version %d", cfg.Version)
+	}
+	if cfg.BlockSize <= 0 {
+		return nil, fmt.Errorf("Invalid block size %d in filesystem config", cfg.BlockSize)
+	}
+	return cfg, nil
+}
+
+/*
+ReplaceConfig atomically replaces the config at the root of the backing
+filesystem, for operations that change the parameters of a tree
+*/
+func ReplaceConfig(backing afero.Fs, cfg *Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ConfigName + ".new"
+	f, err := backing.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = backing.Chmod(tmp, 0444)
+	}
+	if err == nil {
+		err = backing.Rename(tmp, ConfigName)
+	}
+	if err != nil {
+		backing.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,359 @@
+package trfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile"
+)
+
+// Prefix of the converted copy of a file being converted
+const convertPrefix = internalPrefix + "convert."
+
+/*
+Progress reports the files converted so far. Totals are determined
+before the conversion starts, files converted by an earlier, interrupted
+run are not counted.
+*/
+type Progress struct {
+	// Backing path of the file that has just been converted
+	Path       string
+	Files      int64
+	TotalFiles int64
+	// Bytes are counted in plaintext
+	Bytes      int64
+	TotalBytes int64
+	Elapsed    time.Duration
+}
+
+// Throughput returns the plaintext bytes converted per second
+func (p Progress) Throughput() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+/*
+Converts the files of the backing tree of dst in place, file by file. Each
+file is read with open and written transformed by dst into a copy, which
+replaces the file once its contents have been checked.
+*/
+type converter struct {
+	dst *trfs
+	cp  *checkpoint
+	// Reports whether the file at the backing path is converted
+	selects func(path string, info os.FileInfo) bool
+	// Opens the file at the backing path for reading its plaintext
+	open func(path string, info os.FileInfo) (io.ReadCloser, error)
+	// Plaintext size of the file at the backing path
+	size func(path string, info os.FileInfo) int64
+	// Called once a file has been replaced
+	finish func(path string) error
+
+	progress func(Progress)
+	stats    Progress
+	start    time.Time
+}
+
+func (fs *trfs) convertName(path string) string {
+	return fs.sidecarName(path, convertPrefix)
+}
+
+/*
+Walks the regular files of the backing tree that are selected and, unless
+all is set, not converted yet
+*/
+func (c *converter) walk(all bool, fn func(path string, info os.FileInfo) error) error {
+	return afero.Walk(c.dst.Fs, "/", func(path string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			// Removed meanwhile, or listed by a name it can not be found by
+			return nil
+		case err != nil:
+			return err
+		}
+		path = filepath.Clean(path)
+		switch {
+		case info.IsDir() && isInternalName(info.Name()):
+			return filepath.SkipDir
+		case !isRegular(info) || !c.selects(path, info) || (!all && c.cp.converted(c.dst, path)):
+			return nil
+		}
+		return fn(path, info)
+	})
+}
+
+/*
+Converts all files and records the conversion as complete. Resumes an
+interrupted conversion.
+*/
+func (c *converter) run() error {
+	complete, begun, err := c.cp.state(c.dst)
+	if err != nil || complete {
+		return err
+	}
+	// Copies that were not renamed are replaced when the file is converted again
+	for _, path := range begun {
+		if _, err := c.dst.Fs.Stat(c.dst.convertName(path)); os.IsNotExist(err) {
+			if err := c.finishFile(path); err != nil {
+				return err
+			}
+		}
+	}
+	c.start = time.Now()
+	err = c.walk(false, func(path string, info os.FileInfo) error {
+		c.stats.TotalFiles++
+		c.stats.TotalBytes += c.size(path, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Files created while a pass runs can be missed by it
+	for {
+		n := 0
+		err := c.walk(false, func(path string, info os.FileInfo) error {
+			n++
+			return c.convertFile(path, info)
+		})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return c.cp.record(c.dst, "complete", "")
+		}
+	}
+}
+
+// Replaces the file at the backing path with a converted copy
+func (c *converter) convertFile(path string, info os.FileInfo) error {
+	tmp := c.dst.convertName(path)
+	sum, n, err := c.writeCopy(path, tmp, info)
+	if err == nil {
+		err = c.check(tmp, sum)
+	}
+	if err == nil {
+		err = c.dst.Fs.Chmod(tmp, info.Mode().Perm())
+	}
+	if err == nil {
+		err = c.dst.Fs.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		c.dst.Fs.Remove(tmp)
+		return err
+	}
+	if err := c.cp.record(c.dst, "begin", path); err != nil {
+		return err
+	}
+	if err := c.dst.Fs.Rename(tmp, path); err != nil {
+		return err
+	}
+	if err := c.finishFile(path); err != nil {
+		return err
+	}
+	if c.progress != nil {
+		c.stats.Path = path
+		c.stats.Files++
+		c.stats.Bytes += n
+		c.stats.Elapsed = time.Since(c.start)
+		c.progress(c.stats)
+	}
+	return nil
+}
+
+// Opens the transformed file at the backing path, skipping its header
+func (fs *trfs) openTransformed(path string, flag int) (transformfile.File, error) {
+	var (
+		f   afero.File
+		err error
+	)
+	if strings.HasPrefix(filepath.Base(path), attrPrefix) {
+		// Attributes are transformed without a header
+		f, err = fs.Fs.OpenFile(path, flag, 0)
+	} else if flag == os.O_RDONLY {
+		f, err = fs.openDataFile(path, flag)
+	} else if f, err = fs.Fs.OpenFile(path, flag, 0); err == nil {
+		var data afero.File
+		if data, err = fs.openData(f, true); err != nil {
+			f.Close()
+		}
+		f = data
+	}
+	if err != nil {
+		return nil, err
+	}
+	return transformfile.NewFromTransformer(
+		fs.blockSize,
+		fs.overhead,
+		f,
+		flag == os.O_RDONLY,
+		fs.createReadTransformer(),
+		fs.createWriteTransformer(),
+	), nil
+}
+
+// Writes the converted copy, returning the hash and size of the plaintext
+func (c *converter) writeCopy(path, tmp string, info os.FileInfo) ([]byte, int64, error) {
+	src, err := c.open(path, info)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer src.Close()
+	// Gets the permissions of the file once written
+	f, err := c.dst.Fs.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	f.Close()
+	dst, err := c.dst.openTransformed(tmp, os.O_RDWR)
+	if err != nil {
+		return nil, 0, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return h.Sum(nil), n, err
+}
+
+// Checks the copy decodes to the plaintext it was written from
+func (c *converter) check(tmp string, sum []byte) error {
+	f, err := c.dst.openTransformed(tmp, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("Converted copy of %s does not match", tmp)
+	}
+	return nil
+}
+
+// Completes the conversion of a file after its copy has replaced it
+func (c *converter) finishFile(path string) error {
+	if c.finish != nil {
+		if err := c.finish(path); err != nil {
+			return err
+		}
+	}
+	if err := c.cp.record(c.dst, "done", path); err != nil {
+		return err
+	}
+	c.dst.updateUsage(path, path)
+	return nil
+}
+
+// Rebuilds the parity of a converted data file
+func (fs *trfs) rebuildParity(path string) error {
+	if err := fs.truncateParity(path, 0); err != nil {
+		return err
+	}
+	info, err := fs.lstat(path)
+	if err != nil {
+		return err
+	}
+	return fs.updateParity(path, 0, info.Size()-int64(len(fs.header)))
+}
+
+/*
+ReencodeName is the name of the checkpoint at the root of the backing
+filesystem that records the progress of Reencode
+*/
+const ReencodeName = internalPrefix + "reencode"
+
+var (
+	errNotTrfs         = fmt.Errorf("filesystem was not created by trfs")
+	errReencodingNames = fmt.Errorf("re-encoding trees with encrypted names is not supported")
+)
+
+/*
+Reencode converts the files of a tree in place from the format of src to
+the format of dst, for example to change the key or the block size. src
+and dst have to be trfs filesystems on the same backing filesystem with
+the same rules. Attributes are converted along with the files, parity is
+rebuilt and snapshots are removed, as their blocks can not be converted.
+
+Each file is converted into a copy, which replaces the file once it has
+been checked to decode to the same plaintext. Progress is recorded in a
+checkpoint, so an interrupted run continues where it stopped when Reencode
+is called again with the same filesystems. Once all files have been
+converted, a verify pass reads them all through dst before the checkpoint
+is removed. progress may be nil. The tree must not be used meanwhile.
+*/
+func Reencode(src, dst afero.Fs, progress func(Progress)) error {
+	s, ok := src.(*trfs)
+	d, ok2 := dst.(*trfs)
+	if !ok || !ok2 {
+		return errNotTrfs
+	}
+	if s.names != nil || d.names != nil {
+		return errReencodingNames
+	}
+	if err := d.checkWritable("reencode", "/"); err != nil {
+		return err
+	}
+	isAttr := func(info os.FileInfo) bool {
+		return strings.HasPrefix(info.Name(), attrPrefix)
+	}
+	c := &converter{
+		dst: d,
+		cp:  newCheckpoint(filepath.Join(string(filepath.Separator), ReencodeName)),
+		selects: func(path string, info os.FileInfo) bool {
+			return isAttr(info) || (!isInternalName(info.Name()) && d.selected(path))
+		},
+		open: func(path string, info os.FileInfo) (io.ReadCloser, error) {
+			return s.openTransformed(path, os.O_RDONLY)
+		},
+		size: func(path string, info os.FileInfo) int64 {
+			if isAttr(info) {
+				return transformfile.NewFileInfo(info, s.blockSize, s.overhead).Size()
+			}
+			return s.fileInfo(info, path).Size()
+		},
+		finish: func(path string) error {
+			if strings.HasPrefix(filepath.Base(path), attrPrefix) {
+				return nil
+			}
+			if err := d.removeSnapshots(path); err != nil {
+				return err
+			}
+			return d.rebuildParity(path)
+		},
+		progress: progress,
+	}
+	if err := c.run(); err != nil {
+		return err
+	}
+	err := c.walk(true, func(path string, info os.FileInfo) error {
+		f, err := d.openTransformed(path, os.O_RDONLY)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(ioutil.Discard, f); err != nil {
+			return fmt.Errorf("Verifying %s failed: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return d.Fs.Remove(c.cp.path)
+}
@@ -0,0 +1,113 @@
+package trfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/text/transform"
+)
+
+// DeflateCodecName identifies the deflate codec in file headers
+const DeflateCodecName = "deflate"
+
+const (
+	deflateStored     = 0
+	deflateCompressed = 1
+)
+
+var errInvalidDeflateBlock = fmt.Errorf("invalid deflate block")
+
+/*
+DeflateCodec compresses blocks with deflate at the given level, see
+compress/flate. Blocks that do not compress are stored as they are, so
+blocks grow by at most a byte. Panics if the level is invalid.
+*/
+func DeflateCodec(level int) Codec {
+	if _, err := flate.NewWriter(ioutil.Discard, level); err != nil {
+		panic(err)
+	}
+	return Codec{
+		Name:     DeflateCodecName,
+		Overhead: 1,
+		Variable: true,
+		NewReadTransformer: func(blockSize int64) transform.Transformer {
+			return &inflater{blockSize: blockSize}
+		},
+		NewWriteTransformer: func(int64) transform.Transformer {
+			return &deflater{level: level}
+		},
+	}
+}
+
+type deflater struct {
+	transform.NopResetter
+	level int
+}
+
+type inflater struct {
+	transform.NopResetter
+	blockSize int64
+}
+
+func (t *deflater) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !atEOF {
+		return 0, 0, transform.ErrShortSrc
+	}
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte(deflateCompressed)
+	w, err := flate.NewWriter(buf, t.level)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return 0, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, 0, err
+	}
+	b := buf.Bytes()
+	if len(b) > len(src) {
+		b = append([]byte{deflateStored}, src...)
+	}
+	if len(dst) < len(b) {
+		return 0, 0, transform.ErrShortDst
+	}
+	return copy(dst, b), len(src), nil
+}
+
+func (t *inflater) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !atEOF {
+		return 0, 0, transform.ErrShortSrc
+	}
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+	var b []byte
+	switch src[0] {
+	case deflateStored:
+		b = src[1:]
+	case deflateCompressed:
+		// Blocks never inflate beyond the block size
+		r := flate.NewReader(bytes.NewReader(src[1:]))
+		b, err = ioutil.ReadAll(io.LimitReader(r, t.blockSize+1))
+		r.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+		if int64(len(b)) > t.blockSize {
+			return 0, 0, errInvalidDeflateBlock
+		}
+	default:
+		return 0, 0, errInvalidDeflateBlock
+	}
+	if len(dst) < len(b) {
+		return 0, 0, transform.ErrShortDst
+	}
+	return copy(dst, b), len(src), nil
+}
@@ -0,0 +1,221 @@
+package trfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// EventOp is the kind of change an Event reports
+type EventOp int
+
+const (
+	EventCreate EventOp = iota + 1
+	EventWrite
+	EventTruncate
+	EventRename
+	EventRemove
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventCreate:
+		return "create"
+	case EventWrite:
+		return "write"
+	case EventTruncate:
+		return "truncate"
+	case EventRename:
+		return "rename"
+	case EventRemove:
+		return "remove"
+	}
+	return fmt.Sprintf("EventOp(%d)", int(op))
+}
+
+/*
+Event reports a change of a file or directory. Names are plaintext paths.
+Size is the plaintext size of a file after the change, it is not set for
+directories and removals.
+*/
+type Event struct {
+	Op   EventOp
+	Name string
+	// Previous name of a renamed file
+	OldName string
+	Size    int64
+}
+
+/*
+Notifier is implemented by trfs filesystems to report changes.
+
+Subscribe calls fn after each change made through the filesystem, until
+cancel is called. fn is called synchronously by the goroutine making the
+change, so it should not block. Removing a directory tree is reported
+as one event for the directory.
+
+Watch reports changes of the backing directory of name and below,
+including those made by other processes or other filesystems. It needs an
+afero.OsFs backing, possibly below an afero.BasePathFs, and is only
+supported on Linux. Writes are reported as they reach the backing file, so
+one write can be reported several times, and truncation is reported as a
+write.
+*/
+type Notifier interface {
+	Subscribe(fn func(Event)) (cancel func())
+	Watch(name string, fn func(Event)) (io.Closer, error)
+}
+
+var _ Notifier = (*trfs)(nil)
+
+// ErrWatchUnsupported is returned by Watch if the backing can not be watched
+var ErrWatchUnsupported = fmt.Errorf("watching is not supported by the backing filesystem")
+
+type subscriber struct {
+	fn func(Event)
+}
+
+func (fs *trfs) Subscribe(fn func(Event)) func() {
+	s := &subscriber{fn}
+	fs.subsMu.Lock()
+	fs.subs = append(fs.subs, s)
+	fs.subsMu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			fs.subsMu.Lock()
+			defer fs.subsMu.Unlock()
+			for i, other := range fs.subs {
+				if other == s {
+					fs.subs = append(fs.subs[:i:i], fs.subs[i+1:]...)
+					return
+				}
+			}
+		})
+	}
+}
+
+// Reports whether anyone subscribed to events
+func (fs *trfs) watched() bool {
+	fs.subsMu.Lock()
+	defer fs.subsMu.Unlock()
+	return len(fs.subs) > 0
+}
+
+func (fs *trfs) emit(ev Event) {
+	fs.subsMu.Lock()
+	list := fs.subs
+	fs.subsMu.Unlock()
+	ev.Name = filepath.Clean(ev.Name)
+	if ev.OldName != "" {
+		ev.OldName = filepath.Clean(ev.OldName)
+	}
+	for _, s := range list {
+		s.fn(ev)
+	}
+}
+
+// Reports ev with the current size of the file, if err is nil
+func (fs *trfs) notify(err error, ev Event) error {
+	if err != nil || !fs.watched() {
+		return err
+	}
+	if info, err := fs.Stat(ev.Name); err == nil && !info.IsDir() {
+		ev.Size = info.Size()
+	}
+	fs.emit(ev)
+	return nil
+}
+
+/*
+Returns the event opening the backing file at path with flag causes, 0 if
+it does not change the file. Only determined if anyone subscribed.
+*/
+func (fs *trfs) openOp(path string, flag int) EventOp {
+	if !fs.watched() {
+		return 0
+	}
+	if _, err := fs.lstat(path); os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		return EventCreate
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return EventTruncate
+	}
+	return 0
+}
+
+/*
+Returns the directories MkdirAll creates for name, parents first. Only
+determined if anyone subscribed.
+*/
+func (fs *trfs) missingDirs(name string) []string {
+	if !fs.watched() {
+		return nil
+	}
+	var missing []string
+	for dir := filepath.Clean(name); ; dir = filepath.Dir(dir) {
+		if _, err := fs.lstat(dir); !os.IsNotExist(err) {
+			break
+		}
+		missing = append([]string{dir}, missing...)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return missing
+}
+
+/*
+Path of an existing backing file on the operating system, if the backing is
+an afero.OsFs
+*/
+func (fs *trfs) osPath(path string) (string, bool) {
+	switch backing := fs.Fs.(type) {
+	case *afero.OsFs:
+		return path, true
+	case *afero.BasePathFs:
+		// The filesystem below is only known from the files it opens
+		f, err := backing.Open(path)
+		if err != nil {
+			return "", false
+		}
+		defer f.Close()
+		if osFile(f) == nil {
+			return "", false
+		}
+		p, err := backing.RealPath(path)
+		return p, err == nil
+	}
+	return "", false
+}
+
+func (fs *trfs) notifyOpen(op EventOp, name string, f afero.File, err error) (afero.File, error) {
+	if err == nil && op != 0 {
+		fs.emit(Event{Op: op, Name: name})
+	}
+	return f, err
+}
+
+// Reports a write through the handle, if it wrote anything
+func (f *file) notifyWrite(n int, err error) (int, error) {
+	if n > 0 {
+		f.notify(EventWrite)
+	}
+	return n, err
+}
+
+// Reports a change made through the handle with the current size
+func (f *file) notify(op EventOp) {
+	if !f.fs.watched() {
+		return
+	}
+	ev := Event{Op: op, Name: f.name}
+	if info, err := f.File.Stat(); err == nil {
+		ev.Size = info.Size()
+	}
+	f.fs.emit(ev)
+}
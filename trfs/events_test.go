@@ -0,0 +1,58 @@
+package trfs_test
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func eventString(ev trfs.Event) string {
+	if ev.OldName != "" {
+		return fmt.Sprintf("%v %s->%s %d", ev.Op, ev.OldName, ev.Name, ev.Size)
+	}
+	return fmt.Sprintf("%v %s %d", ev.Op, ev.Name, ev.Size)
+}
+
+func TestSubscribe(t *testing.T) {
+	fs := naclfs.New(16, Key("events"), afero.NewMemMapFs())
+	var events []string
+	cancel := fs.(trfs.Notifier).Subscribe(func(ev trfs.Event) {
+		events = append(events, eventString(ev))
+	})
+
+	fs.MkdirAll("/a/b", 0755)
+	f, _ := fs.OpenFile("/a/b/file", os.O_RDWR|os.O_CREATE, 0644)
+	f.Write([]byte("hello world"))
+	f.Truncate(5)
+	f.Close()
+	fs.OpenFile("/a/b/file", os.O_RDONLY, 0)
+	fs.Rename("/a/b/file", "/a/moved")
+	fs.Remove("/a/moved")
+	fs.RemoveAll("/a")
+	fs.RemoveAll("/a")
+
+	expected := []string{
+		"create /a 0",
+		"create /a/b 0",
+		"create /a/b/file 0",
+		"write /a/b/file 11",
+		"truncate /a/b/file 5",
+		"rename /a/b/file->/a/moved 5",
+		"remove /a/moved 0",
+		"remove /a 0",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Unexpected events %q", events)
+	}
+
+	cancel()
+	afero.WriteFile(fs, "/file", []byte("x"), 0644)
+	if len(events) != len(expected) {
+		t.Errorf("Events reported after cancel: %q", events[len(expected):])
+	}
+}
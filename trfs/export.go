@@ -0,0 +1,118 @@
+package trfs
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+/*
+ExportOptions control what ExportTar writes
+*/
+type ExportOptions struct {
+	// Raw exports files as stored in the backing filesystem, with transformed
+	// contents and names and including sidecar files, instead of decrypted
+	Raw bool
+}
+
+/*
+ExportTar writes the tree at root as a tar stream to w. Entries are named
+relative to root and keep the modes and modification times of files,
+directories and symbolic links. By default contents are decrypted, with
+headers carrying the plaintext size. With opts.Raw, which needs a trfs
+filesystem, the backing tree is exported as stored. opts may be nil.
+
+Files should not be written during the export, their entries could be
+inconsistent.
+*/
+func ExportTar(fs afero.Fs, root string, w io.Writer, opts *ExportOptions) error {
+	if opts == nil {
+		opts = new(ExportOptions)
+	}
+	src, start := fs, filepath.Clean(root)
+	if opts.Raw {
+		t, ok := fs.(*trfs)
+		if !ok {
+			return errNotTrfs
+		}
+		path, err := t.backingPath(root)
+		if err != nil {
+			return &os.PathError{Op: "export", Path: root, Err: err}
+		}
+		src, start = t.Fs, filepath.Clean(path)
+	}
+	tw := tar.NewWriter(w)
+	err := afero.Walk(src, start, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err) && path != start:
+			// Removed meanwhile, or listed by a name it can not be found by
+			return nil
+		case err != nil:
+			return err
+		}
+		name, err := filepath.Rel(start, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			if info.IsDir() {
+				return nil
+			}
+			name = filepath.Base(path)
+		}
+		return exportEntry(tw, src, path, filepath.ToSlash(name), info)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Writes the file at path of src as an entry of the tar stream
+func exportEntry(tw *tar.Writer, src afero.Fs, path, name string, info os.FileInfo) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(info.Mode().Perm()),
+		ModTime: info.ModTime(),
+	}
+	switch {
+	case info.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case info.Mode()&os.ModeSymlink != 0:
+		reader, ok := src.(afero.LinkReader)
+		if !ok {
+			return &os.PathError{Op: "readlink", Path: path, Err: afero.ErrNoReadlink}
+		}
+		target, err := reader.ReadlinkIfPossible(path)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+	case info.Mode().IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+	default:
+		// Devices, pipes and sockets have no contents to export
+		return nil
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := src.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+		return &os.PathError{Op: "export", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package trfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+type tarEntry struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+func readTar(t *testing.T, r io.Reader) map[string]tarEntry {
+	entries := make(map[string]tarEntry)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = tarEntry{hdr, data}
+	}
+}
+
+func TestExportTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backing := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	fs := naclfs.New(16, Key("export"), backing)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	content := bytes.Repeat([]byte("exported "), 10)
+	fs.MkdirAll("/data/sub", 0750)
+	afero.WriteFile(fs, "/data/sub/file.txt", content, 0640)
+	afero.WriteFile(fs, "/other.txt", []byte("not exported"), 0644)
+	fs.Chtimes("/data/sub/file.txt", mtime, mtime)
+	if err := fs.(afero.Symlinker).SymlinkIfPossible("sub/file.txt", "/data/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := trfs.ExportTar(fs, "/data", &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	entries := readTar(t, &buf)
+	if len(entries) != 3 {
+		t.Errorf("Unexpected entries %v", entries)
+	}
+	if e := entries["sub/"]; e.hdr == nil || e.hdr.Typeflag != tar.TypeDir || e.hdr.Mode != 0750 {
+		t.Errorf("Unexpected directory entry %+v", e.hdr)
+	}
+	e := entries["sub/file.txt"]
+	if e.hdr == nil || e.hdr.Size != int64(len(content)) || !bytes.Equal(e.data, content) {
+		t.Fatalf("Unexpected file entry %+v, %q", e.hdr, e.data)
+	}
+	if e.hdr.Mode != 0640 || !e.hdr.ModTime.Equal(mtime) {
+		t.Errorf("Unexpected mode %o or mtime %v", e.hdr.Mode, e.hdr.ModTime)
+	}
+	// afero.BasePathFs stores link targets with its base path
+	target, _ := fs.(afero.Symlinker).ReadlinkIfPossible("/data/link")
+	if e := entries["link"]; e.hdr == nil || e.hdr.Typeflag != tar.TypeSymlink || e.hdr.Linkname != target {
+		t.Errorf("Unexpected link entry %+v", e.hdr)
+	}
+
+	buf.Reset()
+	if err := trfs.ExportTar(fs, "/data", &buf, &trfs.ExportOptions{Raw: true}); err != nil {
+		t.Fatal(err)
+	}
+	entries = readTar(t, &buf)
+	raw, _ := afero.ReadFile(backing, "/data/sub/file.txt")
+	e = entries["sub/file.txt"]
+	if e.hdr == nil || e.hdr.Size != int64(len(raw)) || !bytes.Equal(e.data, raw) {
+		t.Errorf("Unexpected raw entry %+v", e.hdr)
+	}
+	if strings.Contains(string(e.data), "exported") {
+		t.Errorf("Raw entry contains plaintext")
+	}
+
+	if err := trfs.ExportTar(afero.NewMemMapFs(), "/", &buf, &trfs.ExportOptions{Raw: true}); err == nil {
+		t.Errorf("Raw export should need a trfs filesystem")
+	}
+}
@@ -0,0 +1,108 @@
+package trfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var errWriteAtInAppendMode = fmt.Errorf("invalid use of WriteAt on file opened with O_APPEND")
+
+/*
+Returns the flags a transformed file is opened with on the backing
+filesystem. Blocks have to be read before they are rewritten, so the
+backing file is always readable when writing. Appending is done by the
+shared open file.
+*/
+func backingFlag(flag int) int {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	return flag &^ os.O_APPEND
+}
+
+func (f *file) checkRead(op string) error {
+	if f.flag&os.O_WRONLY != 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *file) checkWrite(op string) error {
+	if err := f.fs.checkWritable(op, f.name); err != nil {
+		return err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+// Flushes the file after each write if opened with O_SYNC
+func (f *file) syncWrite(n int, err error) (int, error) {
+	if err == nil && f.flag&os.O_SYNC == os.O_SYNC {
+		err = f.File.Sync()
+	}
+	return n, err
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if err := f.checkRead("read"); err != nil {
+		return 0, err
+	}
+	return f.read(p)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.checkRead("read"); err != nil {
+		return 0, err
+	}
+	return f.readAt(p, off)
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if err := f.checkWrite("write"); err != nil {
+		return 0, err
+	}
+	done, err := f.reserve("write", -1, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return f.notifyWrite(f.syncWrite(f.write(p)))
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.checkWrite("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, errWriteAtInAppendMode
+	}
+	done, err := f.reserve("write", off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return f.notifyWrite(f.syncWrite(f.writeAt(p, off)))
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *file) Truncate(size int64) error {
+	if err := f.checkWrite("truncate"); err != nil {
+		return err
+	}
+	done, err := f.reserve("truncate", size, 0)
+	if err != nil {
+		return err
+	}
+	defer done()
+	_, err = f.syncWrite(0, f.File.Truncate(size))
+	if err == nil {
+		f.notify(EventTruncate)
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package trfs_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+)
+
+var flagCases = []struct {
+	name   string
+	exists bool
+	flag   int
+}{
+	{"rdonly", true, os.O_RDONLY},
+	{"rdonly missing", false, os.O_RDONLY},
+	{"wronly", true, os.O_WRONLY},
+	{"rdwr", true, os.O_RDWR},
+	{"create", false, os.O_RDWR | os.O_CREATE},
+	{"create existing", true, os.O_RDWR | os.O_CREATE},
+	{"excl", false, os.O_RDWR | os.O_CREATE | os.O_EXCL},
+	{"excl existing", true, os.O_RDWR | os.O_CREATE | os.O_EXCL},
+	{"trunc", true, os.O_RDWR | os.O_TRUNC},
+	{"append", true, os.O_WRONLY | os.O_APPEND},
+	{"append rdwr", true, os.O_RDWR | os.O_APPEND},
+	{"sync", true, os.O_RDWR | os.O_SYNC},
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// Runs a sequence of operations and records the observable results
+func flagTranscript(fs afero.Fs, dir string, exists bool, flag int) string {
+	var out []string
+	record := func(format string, args ...interface{}) {
+		out = append(out, fmt.Sprintf(format, args...))
+	}
+	name := filepath.Join(dir, "file")
+	if exists {
+		afero.WriteFile(fs, name, []byte("initial content"), 0644)
+	}
+	f, err := fs.OpenFile(name, flag, 0644)
+	record("open %s exist=%v notexist=%v", result(err), os.IsExist(err), os.IsNotExist(err))
+	if err != nil {
+		return strings.Join(out, "\n")
+	}
+	f.Seek(2, io.SeekStart)
+	n, err := f.Write([]byte("AB"))
+	record("write %d %s", n, result(err))
+	n, err = f.WriteAt([]byte("xyz"), 4)
+	record("writeat %d %s", n, result(err))
+	off, _ := f.Seek(0, io.SeekCurrent)
+	record("offset %d", off)
+	f.Seek(0, io.SeekStart)
+	data, err := ioutil.ReadAll(f)
+	record("read %q %s", data, result(err))
+	b := make([]byte, 4)
+	n, err = f.ReadAt(b, 3)
+	record("readat %q %s", b[:n], result(err))
+	record("truncate %s", result(f.Truncate(5)))
+	n, err = f.Write([]byte("end"))
+	record("write %d %s", n, result(err))
+	record("close %s", result(f.Close()))
+	data, err = afero.ReadFile(fs, name)
+	record("contents %q %s", data, result(err))
+	return strings.Join(out, "\n")
+}
+
+func TestOpenFileFlagsMatchOsFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	osFs := afero.NewOsFs()
+	backings := map[string]afero.Fs{
+		"os":  afero.NewBasePathFs(afero.NewOsFs(), dir),
+		"mem": afero.NewMemMapFs(),
+	}
+
+	for i, c := range flagCases {
+		caseDir := filepath.Join(dir, fmt.Sprintf("case%d", i))
+		osFs.Mkdir(caseDir, 0755)
+		expected := flagTranscript(osFs, caseDir, c.exists, c.flag)
+		for backingName, backing := range backings {
+			fs := naclfs.New(4, Key("flags"), backing)
+			caseDir := fmt.Sprintf("/%s-case%d", backingName, i)
+			fs.Mkdir(caseDir, 0755)
+			if got := flagTranscript(fs, caseDir, c.exists, c.flag); got != expected {
+				t.Errorf("%s on %s:\n%s\nexpected:\n%s", c.name, backingName, got, expected)
+			}
+		}
+	}
+}
+
+type syncCountingFs struct {
+	afero.Fs
+	syncs int
+}
+
+type syncCountingFile struct {
+	afero.File
+	fs *syncCountingFs
+}
+
+func (fs *syncCountingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingFile{f, fs}, nil
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.fs.syncs++
+	return f.File.Sync()
+}
+
+func TestOpenFileSync(t *testing.T) {
+	backing := &syncCountingFs{Fs: afero.NewMemMapFs()}
+	fs := naclfs.New(4, Key("flags"), backing)
+	f, err := fs.OpenFile("file", os.O_RDWR|os.O_CREATE|os.O_SYNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("one"))
+	f.WriteAt([]byte("two"), 8)
+	if backing.syncs != 2 {
+		t.Errorf("Expected a sync per write, got %d syncs", backing.syncs)
+	}
+}
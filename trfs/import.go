@@ -0,0 +1,226 @@
+package trfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ErrUnsafeEntry is returned by imports for entries that would end up outside the import root
+var ErrUnsafeEntry = fmt.Errorf("archive entry outside of the import root")
+
+// Creates the entries of an archive below root
+type importer struct {
+	fs   afero.Fs
+	root string
+	// Symbolic links created so far, entries below them are not followed
+	links map[string]bool
+	// Modes and modification times of directories, set once all entries are created
+	dirs []importedDir
+}
+
+type importedDir struct {
+	name  string
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func newImporter(fs afero.Fs, root string) *importer {
+	return &importer{fs: fs, root: filepath.Clean(root), links: make(map[string]bool)}
+}
+
+/*
+ImportTar creates the entries of the tar stream r below root, streaming
+file contents through fs, so they are only stored transformed. Modes and
+modification times of files and directories are kept, symbolic links are
+created, failing if fs does not support them, and other entry types are
+skipped. Entries
+with absolute names, names leaving root or at or below a symbolic link,
+and symbolic links pointing outside of root fail the import with
+ErrUnsafeEntry; entries imported before are left in place.
+*/
+func ImportTar(fs afero.Fs, root string, r io.Reader) error {
+	im := newImporter(fs, root)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return im.finish()
+		}
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = im.dir(hdr.Name, mode, hdr.ModTime)
+		case tar.TypeReg, tar.TypeRegA:
+			err = im.file(hdr.Name, mode, hdr.ModTime, tr)
+		case tar.TypeSymlink:
+			err = im.symlink(hdr.Name, hdr.Linkname)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ImportZip creates the entries of the zip archive of the given size read
+from r below root, like ImportTar
+*/
+func ImportZip(fs afero.Fs, root string, r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	im := newImporter(fs, root)
+	for _, zf := range zr.File {
+		if err := im.zipEntry(zf); err != nil {
+			return err
+		}
+	}
+	return im.finish()
+}
+
+func (im *importer) zipEntry(zf *zip.File) error {
+	mode := zf.Mode()
+	if !mode.IsDir() && !mode.IsRegular() && mode&os.ModeSymlink == 0 {
+		return nil
+	}
+	if mode.IsDir() {
+		return im.dir(zf.Name, mode.Perm(), zf.Modified)
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if mode.IsRegular() {
+		return im.file(zf.Name, mode.Perm(), zf.Modified, rc)
+	}
+	// Zip archives store the target of a symbolic link as its contents
+	target, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return err
+	}
+	return im.symlink(zf.Name, string(target))
+}
+
+/*
+Returns the name an entry is created at, failing for names outside of root
+and at or below symbolic links
+*/
+func (im *importer) path(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", &os.PathError{Op: "import", Path: name, Err: ErrUnsafeEntry}
+	}
+	for dir := path.Dir(clean); dir != "."; dir = path.Dir(dir) {
+		if im.links[dir] {
+			return "", &os.PathError{Op: "import", Path: name, Err: ErrUnsafeEntry}
+		}
+	}
+	p := filepath.Join(im.root, filepath.FromSlash(clean))
+	// Links that exist already, like those of earlier imports, are not followed either
+	if lstater, ok := im.fs.(afero.Lstater); ok {
+		for dir := p; dir != im.root; dir = filepath.Dir(dir) {
+			info, _, err := lstater.LstatIfPossible(dir)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return "", &os.PathError{Op: "import", Path: name, Err: ErrUnsafeEntry}
+			}
+		}
+	}
+	return p, nil
+}
+
+func (im *importer) dir(name string, mode os.FileMode, mtime time.Time) error {
+	p, err := im.path(name)
+	if err != nil {
+		return err
+	}
+	// Read-only directories would prevent creating their entries
+	if err := im.fs.MkdirAll(p, 0700); err != nil {
+		return err
+	}
+	im.dirs = append(im.dirs, importedDir{p, mode, mtime})
+	return nil
+}
+
+func (im *importer) file(name string, mode os.FileMode, mtime time.Time, r io.Reader) error {
+	p, err := im.path(name)
+	if err != nil {
+		return err
+	}
+	if err := im.fs.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := im.fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// The mode the file was created with is subject to the umask
+	if err := im.fs.Chmod(p, mode); err != nil {
+		return err
+	}
+	return im.fs.Chtimes(p, mtime, mtime)
+}
+
+func (im *importer) symlink(name, target string) error {
+	p, err := im.path(name)
+	if err != nil {
+		return err
+	}
+	// The target is resolved relative to the directory of the link
+	resolved := path.Join(path.Dir(path.Clean(name)), target)
+	if path.IsAbs(target) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return &os.PathError{Op: "import", Path: name, Err: ErrUnsafeEntry}
+	}
+	linker, ok := im.fs.(afero.Linker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: target, New: p, Err: afero.ErrNoSymlink}
+	}
+	if err := im.fs.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := linker.SymlinkIfPossible(filepath.FromSlash(target), p); err != nil {
+		return err
+	}
+	im.links[path.Clean(name)] = true
+	return nil
+}
+
+// Sets the modes and modification times of directories, which creating entries changes
+func (im *importer) finish() error {
+	for _, d := range im.dirs {
+		if err := im.fs.Chmod(d.name, d.mode); err != nil {
+			return err
+		}
+		if err := im.fs.Chtimes(d.name, d.mtime, d.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package trfs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func tarArchive(t *testing.T, hdrs ...*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(hdr.Uname))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// Regular file entry, with the contents passed as user name
+func tarFile(name, content string, mode int64, mtime time.Time) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeReg, Name: name, Uname: content, Size: int64(len(content)), Mode: mode, ModTime: mtime}
+}
+
+func TestImportTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backing := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	fs := naclfs.New(16, Key("import"), backing)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	archive := tarArchive(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "data/", Mode: 0550, ModTime: mtime},
+		tarFile("data/file.txt", "imported contents", 0640, mtime),
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "data/link", Linkname: "file.txt", ModTime: mtime},
+	)
+	if err := trfs.ImportTar(fs, "/in", archive); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(fs, "/in/data/file.txt"); err != nil || string(d) != "imported contents" {
+		t.Errorf("Unexpected contents %q, %v", d, err)
+	}
+	if _, err := fs.(afero.Symlinker).ReadlinkIfPossible("/in/data/link"); err != nil {
+		t.Errorf("Link was not imported: %v", err)
+	}
+	if raw, _ := afero.ReadFile(backing, "/in/data/file.txt"); bytes.Contains(raw, []byte("imported")) {
+		t.Errorf("Contents are stored in plaintext")
+	}
+	info, err := fs.Stat("/in/data/file.txt")
+	if err != nil || info.Mode() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Unexpected file info %v, %v", info, err)
+	}
+	info, err = fs.Stat("/in/data")
+	if err != nil || info.Mode().Perm() != 0550 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Unexpected directory info %v, %v", info, err)
+	}
+	fs.Chmod("/in/data", 0750)
+
+	for _, hdrs := range [][]*tar.Header{
+		{tarFile("../escaped", "x", 0644, mtime)},
+		{tarFile("/absolute", "x", 0644, mtime)},
+		{&tar.Header{Typeflag: tar.TypeSymlink, Name: "sub/link", Linkname: "../../escaped"}},
+		{
+			&tar.Header{Typeflag: tar.TypeSymlink, Name: "self", Linkname: "."},
+			&tar.Header{Typeflag: tar.TypeSymlink, Name: "self/up", Linkname: ".."},
+		},
+	} {
+		if err := trfs.ImportTar(fs, "/unsafe", tarArchive(t, hdrs...)); !isUnsafe(err) {
+			t.Errorf("Expected %s to be rejected, got %v", hdrs[len(hdrs)-1].Name, err)
+		}
+	}
+	// Links of an earlier import are not followed
+	if err := trfs.ImportTar(fs, "/links", tarArchive(t,
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "a", Linkname: "."},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "b", Linkname: "a/.."},
+	)); err != nil {
+		t.Fatal(err)
+	}
+	for _, hdr := range []*tar.Header{tarFile("b/escaped", "x", 0644, mtime), tarFile("a", "x", 0644, mtime)} {
+		if err := trfs.ImportTar(fs, "/links", tarArchive(t, hdr)); !isUnsafe(err) {
+			t.Errorf("Expected %s to be rejected, got %v", hdr.Name, err)
+		}
+	}
+	if _, err := fs.Stat("/escaped"); !os.IsNotExist(err) {
+		t.Errorf("Entry was created outside of the import root")
+	}
+}
+
+func isUnsafe(err error) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == trfs.ErrUnsafeEntry
+}
+
+func TestImportZip(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs := naclfs.New(16, Key("import"), backing)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	hdr := &zip.FileHeader{Name: "dir/file.txt", Method: zip.Deflate, Modified: mtime}
+	hdr.SetMode(0600)
+	w, _ := zw.CreateHeader(hdr)
+	w.Write(bytes.Repeat([]byte("zipped "), 20))
+	zw.Close()
+	if err := trfs.ImportZip(fs, "/", bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(fs, "/dir/file.txt"); err != nil || !bytes.Equal(d, bytes.Repeat([]byte("zipped "), 20)) {
+		t.Errorf("Unexpected contents %q, %v", d, err)
+	}
+	info, err := fs.Stat("/dir/file.txt")
+	if err != nil || info.Mode() != 0600 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Unexpected file info %v, %v", info, err)
+	}
+
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	zw.Create("../escaped")
+	zw.Close()
+	if err := trfs.ImportZip(fs, "/", bytes.NewReader(buf.Bytes()), int64(buf.Len())); !isUnsafe(err) {
+		t.Errorf("Expected traversal to be rejected, got %v", err)
+	}
+}
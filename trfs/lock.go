@@ -0,0 +1,386 @@
+package trfs
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+/*
+Locker is implemented by handles of files opened through trfs. Locks are
+advisory and held by the handle, they are released when it is closed.
+Handles of the same filesystem exclude each other in-process. If the
+backing filesystem is an afero.OsFs, locks are also taken on the backing
+file, so they exclude other processes.
+
+Ranges are given in plaintext offsets. A length of 0 extends a range to
+the end of file and beyond. The ranges of transformed files are widened to
+whole blocks, because writing a byte rewrites its block, so ranges that
+share a block conflict.
+*/
+type Locker interface {
+	// Lock waits for an exclusive lock on the whole file
+	Lock() error
+	// TryLock takes an exclusive lock on the whole file, if it is not locked
+	TryLock() (bool, error)
+	// RLock waits for a shared lock on the whole file
+	RLock() error
+	// Unlock releases all locks of the handle
+	Unlock() error
+	LockRange(off, n int64) error
+	TryLockRange(off, n int64) (bool, error)
+	RLockRange(off, n int64) error
+	UnlockRange(off, n int64) error
+}
+
+var _ Locker = (*file)(nil)
+
+type lockKind int
+
+const (
+	unlocked lockKind = iota
+	sharedLock
+	exclusiveLock
+)
+
+// Range of the backing file locked by a handle, end is exclusive
+type heldLock struct {
+	owner      *file
+	start, end int64
+	kind       lockKind
+}
+
+/*
+Locks held on one backing file. os is the backing file locks are
+taken on for other processes, nil if the backing filesystem is not an
+afero.OsFs.
+*/
+type lockTable struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	locks []heldLock
+	os    *os.File
+	// Handles that have used the table
+	refs int
+}
+
+/*
+Returns the lock table of the handle, creating it on first use. Fails if
+the handle has been closed.
+*/
+func (fs *trfs) lockTable(op string, f *file) (*lockTable, error) {
+	fs.filesMu.Lock()
+	defer fs.filesMu.Unlock()
+	if f.closed {
+		return nil, &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if f.locks != nil {
+		return f.locks, nil
+	}
+	path := filepath.Clean(f.currentPath())
+	t, ok := fs.locks[path]
+	if !ok {
+		t = &lockTable{os: fs.openLockFile(path)}
+		t.cond = sync.NewCond(&t.mu)
+		fs.locks[path] = t
+	}
+	t.refs++
+	f.locks = t
+	return t, nil
+}
+
+/*
+Opens the backing file for taking locks of other processes on it. The
+file is opened separately, so closing handles does not drop the locks.
+*/
+func (fs *trfs) openLockFile(path string) *os.File {
+	if !haveOSLocks {
+		return nil
+	}
+	flag := os.O_RDWR
+	if fs.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := fs.Fs.OpenFile(path, flag, 0)
+	if err != nil {
+		// Enough for shared locks
+		if f, err = fs.Fs.OpenFile(path, os.O_RDONLY, 0); err != nil {
+			return nil
+		}
+	}
+	if osf := osFile(f); osf != nil {
+		return osf
+	}
+	f.Close()
+	return nil
+}
+
+// Unwraps the os.File of a file opened on an afero.OsFs
+func osFile(f afero.File) *os.File {
+	switch f := f.(type) {
+	case *os.File:
+		return f
+	case *afero.BasePathFile:
+		return osFile(f.File)
+	}
+	return nil
+}
+
+// Drops all locks of the handle before it is closed
+func (fs *trfs) releaseLocks(f *file) {
+	fs.filesMu.Lock()
+	t := f.locks
+	f.locks, f.closed = nil, true
+	fs.filesMu.Unlock()
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.set(f, 0, math.MaxInt64, unlocked)
+	t.syncOS(0, math.MaxInt64)
+	t.cond.Broadcast()
+	t.mu.Unlock()
+
+	fs.filesMu.Lock()
+	defer fs.filesMu.Unlock()
+	t.refs--
+	if t.refs > 0 {
+		return
+	}
+	for path, other := range fs.locks {
+		if other == t {
+			delete(fs.locks, path)
+		}
+	}
+	if t.os != nil {
+		t.os.Close()
+	}
+}
+
+// Path of the backing file, following renames of open transformed files
+func (f *file) currentPath() string {
+	if shared, ok := f.File.(*sharedFile); ok {
+		return shared.path()
+	}
+	return f.path
+}
+
+/*
+Translates a plaintext range to the range of the backing file. Ranges of
+transformed files are widened to whole blocks and shifted by the header.
+*/
+func (f *file) lockRange(op string, off, n int64) (int64, int64, error) {
+	if off < 0 || n < 0 {
+		return 0, 0, &os.PathError{Op: op, Path: f.name, Err: syscall.EINVAL}
+	}
+	end := int64(math.MaxInt64)
+	if n > 0 && off+n > off {
+		end = off + n
+	}
+	shared, ok := f.File.(*sharedFile)
+	if !ok {
+		return off, end, nil
+	}
+	header := int64(0)
+	shared.entry.mu.Lock()
+	if data, ok := shared.entry.backing.File.(*offsetFile); ok {
+		header = data.offset
+	}
+	shared.entry.mu.Unlock()
+	bs, ebs := f.fs.blockSize, f.fs.encodedBlockSize()
+	start := off/bs*ebs + header
+	if blocks := (end-1)/bs + 1; end != math.MaxInt64 && blocks <= (math.MaxInt64-header)/ebs {
+		end = blocks*ebs + header
+	} else {
+		end = math.MaxInt64
+	}
+	return start, end, nil
+}
+
+func (f *file) lock(op string, off, n int64, kind lockKind, wait bool) (bool, error) {
+	start, end, err := f.lockRange(op, off, n)
+	if err != nil {
+		return false, err
+	}
+	t, err := f.fs.lockTable(op, f)
+	if err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		for t.conflicts(f, start, end, kind) {
+			if !wait {
+				return false, nil
+			}
+			t.cond.Wait()
+		}
+		prev := append([]heldLock(nil), t.locks...)
+		t.set(f, start, end, kind)
+		if t.os == nil {
+			return true, nil
+		}
+		err := osLock(t.os, start, end, kind, false)
+		if err == nil {
+			return true, nil
+		}
+		t.locks = prev
+		if !isLockConflict(err) {
+			return false, &os.PathError{Op: op, Path: f.name, Err: err}
+		}
+		if !wait {
+			return false, nil
+		}
+		/*
+			Another process holds a conflicting lock. Other handles must be
+			able to unlock while this waits for it, as the other process may
+			be waiting for them. The lock taken by waiting is not in the
+			table, so it is taken again, unless handles have changed the
+			locks meanwhile.
+		*/
+		t.mu.Unlock()
+		err = osLock(t.os, start, end, kind, true)
+		t.mu.Lock()
+		if err != nil {
+			return false, &os.PathError{Op: op, Path: f.name, Err: err}
+		}
+		if t.conflicts(f, start, end, kind) {
+			if err := t.syncOS(start, end); err != nil {
+				return false, &os.PathError{Op: op, Path: f.name, Err: err}
+			}
+		}
+	}
+}
+
+func (f *file) unlock(op string, off, n int64) error {
+	start, end, err := f.lockRange(op, off, n)
+	if err != nil {
+		return err
+	}
+	t, err := f.fs.lockTable(op, f)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.set(f, start, end, unlocked)
+	t.cond.Broadcast()
+	if err := t.syncOS(start, end); err != nil {
+		return &os.PathError{Op: op, Path: f.name, Err: err}
+	}
+	return nil
+}
+
+func (f *file) Lock() error {
+	_, err := f.lock("lock", 0, 0, exclusiveLock, true)
+	return err
+}
+
+func (f *file) TryLock() (bool, error) {
+	return f.lock("lock", 0, 0, exclusiveLock, false)
+}
+
+func (f *file) RLock() error {
+	_, err := f.lock("lock", 0, 0, sharedLock, true)
+	return err
+}
+
+func (f *file) Unlock() error {
+	return f.unlock("unlock", 0, 0)
+}
+
+func (f *file) LockRange(off, n int64) error {
+	_, err := f.lock("lock", off, n, exclusiveLock, true)
+	return err
+}
+
+func (f *file) TryLockRange(off, n int64) (bool, error) {
+	return f.lock("lock", off, n, exclusiveLock, false)
+}
+
+func (f *file) RLockRange(off, n int64) error {
+	_, err := f.lock("lock", off, n, sharedLock, true)
+	return err
+}
+
+func (f *file) UnlockRange(off, n int64) error {
+	return f.unlock("unlock", off, n)
+}
+
+func (f *file) Close() error {
+	f.fs.releaseLocks(f)
+	return f.File.Close()
+}
+
+// Reports whether a lock of other handles conflicts with the range
+func (t *lockTable) conflicts(owner *file, start, end int64, kind lockKind) bool {
+	for _, l := range t.locks {
+		if l.owner != owner && l.start < end && start < l.end &&
+			(kind == exclusiveLock || l.kind == exclusiveLock) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the locks of owner in the range
+func (t *lockTable) set(owner *file, start, end int64, kind lockKind) {
+	locks := t.locks[:0:0]
+	for _, l := range t.locks {
+		if l.owner != owner || l.end <= start || end <= l.start {
+			locks = append(locks, l)
+			continue
+		}
+		if l.start < start {
+			locks = append(locks, heldLock{owner, l.start, start, l.kind})
+		}
+		if end < l.end {
+			locks = append(locks, heldLock{owner, end, l.end, l.kind})
+		}
+	}
+	if kind != unlocked {
+		locks = append(locks, heldLock{owner, start, end, kind})
+	}
+	t.locks = locks
+}
+
+/*
+Brings the locks on the backing file in the range in line with the
+strongest lock handles hold on each part of it. One open file holds the
+locks of all handles, so a lock is only released when no handle needs it.
+*/
+func (t *lockTable) syncOS(start, end int64) error {
+	if t.os == nil {
+		return nil
+	}
+	bounds := []int64{start, end}
+	for _, l := range t.locks {
+		for _, b := range []int64{l.start, l.end} {
+			if start < b && b < end {
+				bounds = append(bounds, b)
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	for i := 0; i+1 < len(bounds); i++ {
+		from, to := bounds[i], bounds[i+1]
+		if from == to {
+			continue
+		}
+		kind := unlocked
+		for _, l := range t.locks {
+			if l.start <= from && to <= l.end && l.kind > kind {
+				kind = l.kind
+			}
+		}
+		if err := osLock(t.os, from, to, kind, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
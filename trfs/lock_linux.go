@@ -0,0 +1,44 @@
+package trfs
+
+import (
+	"io"
+	"math"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const haveOSLocks = true
+
+/*
+Takes open file description locks, which belong to the open file like
+flock locks, instead of the process, and support ranges like fcntl locks
+*/
+func osLock(f *os.File, start, end int64, kind lockKind, wait bool) error {
+	lk := syscall.Flock_t{Whence: io.SeekStart, Start: start}
+	if end != math.MaxInt64 {
+		lk.Len = end - start
+	}
+	switch kind {
+	case unlocked:
+		lk.Type = syscall.F_UNLCK
+	case sharedLock:
+		lk.Type = syscall.F_RDLCK
+	case exclusiveLock:
+		lk.Type = syscall.F_WRLCK
+	}
+	cmd := unix.F_OFD_SETLK
+	if wait {
+		cmd = unix.F_OFD_SETLKW
+	}
+	for {
+		if err := syscall.FcntlFlock(f.Fd(), cmd, &lk); err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func isLockConflict(err error) bool {
+	return err == syscall.EAGAIN || err == syscall.EACCES
+}
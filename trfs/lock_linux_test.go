@@ -0,0 +1,101 @@
+package trfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+)
+
+// Filesystems that do not share state only exclude each other through the backing file
+func TestLockBackingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newFs := func() afero.Fs {
+		return naclfs.New(16, Key("lock"), afero.NewBasePathFs(afero.NewOsFs(), dir))
+	}
+	fa, a := openLocker(t, newFs(), "/file")
+	defer fa.Close()
+	fb, b := openLocker(t, newFs(), "/file")
+	defer fb.Close()
+
+	if err := a.LockRange(16, 16); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.TryLockRange(20, 1); ok || err != nil {
+		t.Errorf("Lock on the backing file should conflict: %v, %v", ok, err)
+	}
+	if ok, err := b.TryLockRange(0, 16); !ok || err != nil {
+		t.Errorf("Lock on a different block should succeed: %v, %v", ok, err)
+	}
+	if err := a.RLockRange(16, 16); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := b.TryLockRange(20, 1); ok {
+		t.Errorf("Shared lock on the backing file should conflict with exclusive lock")
+	}
+	a.Unlock()
+	if ok, err := b.TryLock(); !ok || err != nil {
+		t.Errorf("Lock should succeed after unlock: %v, %v", ok, err)
+	}
+}
+
+// Waiting for another process must not keep handles of the same filesystem from unlocking
+func TestLockWaitBackingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := naclfs.New(16, Key("lock"), afero.NewBasePathFs(afero.NewOsFs(), dir))
+	other := naclfs.New(16, Key("lock"), afero.NewBasePathFs(afero.NewOsFs(), dir))
+	fa, a := openLocker(t, fs, "/file")
+	defer fa.Close()
+	fb, b := openLocker(t, fs, "/file")
+	defer fb.Close()
+	fc, c := openLocker(t, other, "/file")
+	defer fc.Close()
+
+	if err := a.LockRange(0, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LockRange(16, 16); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error)
+	go func() {
+		locked <- b.LockRange(16, 16)
+	}()
+	// Give the lock time to block on the backing file
+	time.Sleep(50 * time.Millisecond)
+	unlocked := make(chan error)
+	go func() {
+		unlocked <- a.Unlock()
+	}()
+	select {
+	case err := <-unlocked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unlock is blocked by a lock waiting for another process")
+	}
+	if ok, err := c.TryLockRange(0, 16); !ok || err != nil {
+		t.Errorf("Lock should succeed after unlock: %v, %v", ok, err)
+	}
+	if err := c.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.TryLockRange(20, 1); ok || err != nil {
+		t.Errorf("Lock taken after waiting should conflict: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package trfs
+
+import "os"
+
+// Locks are only taken in-process
+const haveOSLocks = false
+
+func osLock(f *os.File, start, end int64, kind lockKind, wait bool) error {
+	return nil
+}
+
+func isLockConflict(err error) bool {
+	return false
+}
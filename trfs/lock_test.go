@@ -0,0 +1,89 @@
+package trfs_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func openLocker(t *testing.T, fs afero.Fs, name string) (afero.File, trfs.Locker) {
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, f.(trfs.Locker)
+}
+
+func TestLock(t *testing.T) {
+	fs := naclfs.New(16, Key("lock"), afero.NewMemMapFs())
+	fa, a := openLocker(t, fs, "/file")
+	defer fa.Close()
+	fb, b := openLocker(t, fs, "/file")
+	defer fb.Close()
+
+	if err := a.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.TryLock(); ok || err != nil {
+		t.Errorf("Exclusive lock taken twice: %v, %v", ok, err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		b.RLock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("RLock did not wait for exclusive lock")
+	case <-time.After(20 * time.Millisecond):
+	}
+	a.Unlock()
+	<-locked
+	if err := a.RLock(); err != nil {
+		t.Errorf("Shared locks should not conflict: %v", err)
+	}
+	if ok, _ := a.TryLock(); ok {
+		t.Errorf("Upgrading a lock shared with another handle should fail")
+	}
+	fb.Close()
+	if ok, _ := a.TryLock(); !ok {
+		t.Errorf("Closing a handle should release its locks")
+	}
+}
+
+func TestLockRange(t *testing.T) {
+	fs := naclfs.New(16, Key("lock"), afero.NewMemMapFs())
+	fa, a := openLocker(t, fs, "/file")
+	defer fa.Close()
+	fb, b := openLocker(t, fs, "/file")
+	defer fb.Close()
+
+	if err := a.LockRange(0, 10); err != nil {
+		t.Fatal(err)
+	}
+	// Ranges cover whole blocks of 16 bytes
+	if ok, _ := b.TryLockRange(12, 2); ok {
+		t.Errorf("Ranges in the same block should conflict")
+	}
+	if ok, _ := b.TryLockRange(16, 16); !ok {
+		t.Errorf("Ranges in different blocks should not conflict")
+	}
+	if ok, _ := a.TryLock(); ok {
+		t.Errorf("Whole file lock should conflict with range")
+	}
+	b.UnlockRange(16, 16)
+	if ok, _ := a.TryLockRange(20, 0); !ok {
+		t.Errorf("Lock should succeed after range was unlocked")
+	}
+	if _, err := a.TryLockRange(-1, 1); err == nil {
+		t.Errorf("Negative offsets should be rejected")
+	}
+	fa.Close()
+	if err := a.Lock(); err == nil {
+		t.Errorf("Locking a closed handle should fail")
+	}
+}
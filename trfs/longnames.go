@@ -0,0 +1,117 @@
+package trfs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+/*
+DefaultMaxNameLength is the longest encrypted name stored as is, matching
+the limit of common Linux filesystems
+*/
+const DefaultMaxNameLength = 255
+
+const (
+	longNamePrefix = internalPrefix + "longname."
+	longNameSuffix = ".name"
+)
+
+/*
+WithMaxNameLength sets the longest encrypted name that is stored as is on
+the backing filesystem. Longer names are stored under a short name derived
+from their hash, with the full encrypted name kept in a sidecar file.
+*/
+func WithMaxNameLength(n int) Option {
+	return func(fs *trfs) {
+		fs.maxNameLength = n
+	}
+}
+
+// Returns the name of the backing entry for an entry of the given backing directory
+func (fs *trfs) backingName(dir, name string) (string, error) {
+	enc, err := fs.encryptName(dir, name)
+	if err != nil {
+		return "", err
+	}
+	if len(enc) <= fs.maxNameLength {
+		return enc, nil
+	}
+	hash := sha256.Sum256([]byte(enc))
+	return longNamePrefix + base64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
+
+/*
+Room reserved after the prefix and name of a sidecar for its longest
+suffix, a dot and the ID of a snapshot
+*/
+const sidecarSuffixRoom = 20
+
+// Bytes of the hash naming sidecars of entries with long names
+const sidecarHashSize = 16
+
+/*
+Returns the backing path of a sidecar of the entry at the backing path,
+named by the prefix and the name of the entry. If that would leave no room
+for a suffix within the name length limit, a hash of the name is used
+instead.
+*/
+func (fs *trfs) sidecarName(path, prefix string) string {
+	dir, base := filepath.Split(path)
+	if len(prefix)+len(base)+sidecarSuffixRoom > fs.maxNameLength {
+		hash := sha256.Sum256([]byte(base))
+		base = base64.RawURLEncoding.EncodeToString(hash[:sidecarHashSize])
+	}
+	return filepath.Join(dir, prefix+base)
+}
+
+func isLongName(name string) bool {
+	return strings.HasPrefix(name, longNamePrefix) && !strings.HasSuffix(name, longNameSuffix)
+}
+
+/*
+Writes the sidecar holding the full encrypted name, if the backing entry
+at path uses a shortened name. Must be called after creating an entry.
+*/
+func (fs *trfs) storeLongName(name, path string) error {
+	if fs.names == nil || !isLongName(filepath.Base(path)) {
+		return nil
+	}
+	enc, err := fs.encryptName(filepath.Dir(path), filepath.Base(filepath.Clean(name)))
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs.Fs, path+longNameSuffix, []byte(enc), 0444)
+}
+
+// Removes the sidecar of an entry with a shortened name
+func (fs *trfs) removeLongName(path string) error {
+	if fs.names == nil || !isLongName(filepath.Base(path)) {
+		return nil
+	}
+	return fs.removeSidecar(path + longNameSuffix)
+}
+
+// Reads the full encrypted name of an entry with a shortened name
+func (fs *trfs) readLongName(path string) (string, error) {
+	enc, err := afero.ReadFile(fs.Fs, path+longNameSuffix)
+	if err != nil {
+		return "", err
+	}
+	return string(enc), nil
+}
+
+// Creates the sidecar for newly created files
+func (fs *trfs) storeLongNameIfCreated(name, path string, flag int) error {
+	if flag&os.O_CREATE == 0 {
+		return nil
+	}
+	if _, err := fs.Fs.Stat(path + longNameSuffix); err == nil {
+		return nil
+	}
+	return fs.storeLongName(name, path)
+}
@@ -0,0 +1,155 @@
+package trfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+// Wraps a filesystem and rejects names longer than max
+type nameLimitFs struct {
+	afero.Fs
+	max int
+}
+
+func (fs *nameLimitFs) check(op, name string) error {
+	for _, c := range strings.Split(filepath.Clean(name), string(filepath.Separator)) {
+		if len(c) > fs.max {
+			return &os.PathError{Op: op, Path: name, Err: syscall.ENAMETOOLONG}
+		}
+	}
+	return nil
+}
+
+func (fs *nameLimitFs) Create(name string) (afero.File, error) {
+	if err := fs.check("open", name); err != nil {
+		return nil, err
+	}
+	return fs.Fs.Create(name)
+}
+
+func (fs *nameLimitFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if err := fs.check("open", name); err != nil {
+		return nil, err
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func (fs *nameLimitFs) Mkdir(name string, perm os.FileMode) error {
+	if err := fs.check("mkdir", name); err != nil {
+		return err
+	}
+	return fs.Fs.Mkdir(name, perm)
+}
+
+func (fs *nameLimitFs) Rename(oldname, newname string) error {
+	if err := fs.check("rename", newname); err != nil {
+		return err
+	}
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func TestLongNames(t *testing.T) {
+	backing := &nameLimitFs{afero.NewMemMapFs(), 64}
+	fs := naclfs.New(16, Key("names"), backing,
+		naclfs.WithNameEncryption(Key("names")),
+		trfs.WithMaxNameLength(64),
+	)
+
+	long := strings.Repeat("long name ", 10)
+	if err := fs.Mkdir("/"+long, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("/", long, long+".txt")
+	if err := afero.WriteFile(fs, path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	afero.WriteFile(fs, filepath.Join("/", long, "short"), []byte("short"), 0644)
+
+	names, err := afero.ReadDir(fs, "/"+long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, info := range names {
+		found = append(found, info.Name())
+	}
+	sort.Strings(found)
+	if len(found) != 2 || found[0] != long+".txt" || found[1] != "short" {
+		t.Errorf("Unexpected directory entries %q", found)
+	}
+
+	renamed := filepath.Join("/", long, "renamed "+long)
+	if err := fs.Rename(path, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename(filepath.Join("/", long, "short"), filepath.Join("/", long, long)); err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := fs.Open("/" + long)
+	found, _ = dir.Readdirnames(-1)
+	dir.Close()
+	sort.Strings(found)
+	if len(found) != 2 || found[0] != long || found[1] != "renamed "+long {
+		t.Errorf("Unexpected directory entries after rename %q", found)
+	}
+	if d, err := afero.ReadFile(fs, renamed); err != nil || string(d) != "content" {
+		t.Errorf("Unexpected contents after rename %q, %v", d, err)
+	}
+
+	fs.Remove(renamed)
+	fs.Remove(filepath.Join("/", long, long))
+	if err := fs.Remove("/" + long); err != nil {
+		t.Fatal(err)
+	}
+	root, _ := backing.Open("/")
+	left, _ := root.Readdirnames(-1)
+	root.Close()
+	if len(left) != 1 {
+		t.Errorf("Expected only the root IV to be left, got %v", left)
+	}
+}
+
+func TestLongNameSidecars(t *testing.T) {
+	backing := &nameLimitFs{afero.NewMemMapFs(), 64}
+	fs := naclfs.New(16, Key("names"), backing,
+		naclfs.WithNameEncryption(Key("names")),
+		trfs.WithMaxNameLength(64),
+		trfs.WithParity(2, 1),
+	)
+	// Names whose encryption fits the limit, but not with a sidecar prefix, and overlong names
+	for _, name := range []string{"/" + strings.Repeat("n", 30), "/" + strings.Repeat("long name ", 10)} {
+		if err := afero.WriteFile(fs, name, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.(trfs.Attributer).SetAttr(name, "user.tag", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		id, err := fs.(trfs.Snapshotter).Snapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := afero.WriteFile(fs, name, []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if d := readSnapshot(t, fs.(trfs.Snapshotter), name, id); d != "content" {
+			t.Errorf("Unexpected snapshot contents %q", d)
+		}
+		if v, err := fs.(trfs.Attributer).GetAttr(name, "user.tag"); err != nil || string(v) != "value" {
+			t.Errorf("Unexpected attribute %q, %v", v, err)
+		}
+		if err := fs.Rename(name, name+"2"); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := fs.(trfs.Attributer).GetAttr(name+"2", "user.tag"); err != nil || string(v) != "value" {
+			t.Errorf("Unexpected attribute after rename %q, %v", v, err)
+		}
+	}
+}
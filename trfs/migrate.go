@@ -0,0 +1,76 @@
+package trfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+/*
+MigrationName is the name of the checkpoint at the root of the backing
+filesystem that records the progress of a migration
+*/
+const MigrationName = internalPrefix + "migration"
+
+var (
+	errNotMigrating   = fmt.Errorf("filesystem was not created with WithMigration")
+	errMigratingNames = fmt.Errorf("migrating trees with encrypted names is not supported")
+)
+
+/*
+WithMigration serves a tree that is being converted by Migrate. Files that
+have not been converted yet, including files created during the migration,
+are passed through unchanged, converted files are transformed. Once the
+migration is complete all files are transformed, like without the option.
+Progress is read from the checkpoint whenever it changes, so the tree can be
+served by other filesystems and processes while Migrate converts it.
+Filesystems created after an interrupted migration read where it stopped.
+*/
+func WithMigration() Option {
+	return func(fs *trfs) {
+		// Relative names are not found by walks on some backings
+		fs.migration = newCheckpoint(filepath.Join(string(filepath.Separator), MigrationName))
+	}
+}
+
+/*
+Migrate converts the files of a plaintext tree in place, so fs serves the
+tree transformed once it returns. fs has to be created with WithMigration
+on the plaintext tree as backing filesystem. Each file is converted into
+a copy that atomically replaces it, progress is recorded in a checkpoint,
+so an interrupted migration continues where it stopped when Migrate is
+called again. Files excluded by the rules are left as they are.
+
+Files must not be written while they are converted, the conversion of a
+file does not see writes made meanwhile.
+*/
+func Migrate(fs afero.Fs) error {
+	t, ok := fs.(*trfs)
+	if !ok || t.migration == nil {
+		return errNotMigrating
+	}
+	if err := t.checkWritable("migrate", "/"); err != nil {
+		return err
+	}
+	if t.names != nil {
+		return errMigratingNames
+	}
+	c := &converter{
+		dst: t,
+		cp:  t.migration,
+		selects: func(path string, info os.FileInfo) bool {
+			return !isInternalName(info.Name()) && t.selected(path)
+		},
+		open: func(path string, info os.FileInfo) (io.ReadCloser, error) {
+			return t.Fs.Open(path)
+		},
+		size: func(path string, info os.FileInfo) int64 {
+			return info.Size()
+		},
+		finish: t.rebuildParity,
+	}
+	return c.run()
+}
@@ -0,0 +1,109 @@
+package trfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+// Fails renames after the given number of them
+type failingRenameFs struct {
+	afero.Fs
+	renames int
+}
+
+func (fs *failingRenameFs) Rename(oldname, newname string) error {
+	if fs.renames == 0 {
+		return fmt.Errorf("interrupted")
+	}
+	fs.renames--
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func TestMigrate(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	files := map[string][]byte{
+		"/a.txt":     []byte("first file"),
+		"/dir/b.bin": bytes.Repeat([]byte("second file "), 10),
+		"/dir/c.txt": []byte("third file"),
+		"/skip.log":  []byte("excluded"),
+	}
+	for name, data := range files {
+		afero.WriteFile(backing, name, data, 0644)
+	}
+	newFs := func(backing afero.Fs) afero.Fs {
+		return naclfs.New(16, Key("migrate"), backing,
+			trfs.WithMigration(), trfs.WithRules(trfs.Exclude("*.log")))
+	}
+	check := func(fs afero.Fs) {
+		for name, data := range files {
+			if d, err := afero.ReadFile(fs, name); err != nil || !bytes.Equal(d, data) {
+				t.Errorf("Unexpected contents of %s: %q, %v", name, d, err)
+			}
+		}
+	}
+
+	// Interrupted after converting one file
+	if err := trfs.Migrate(newFs(&failingRenameFs{backing, 1})); err == nil {
+		t.Fatalf("Migration should have been interrupted")
+	}
+	fs := newFs(backing)
+	check(fs)
+	files["/dir/new.txt"] = []byte("created during migration")
+	afero.WriteFile(fs, "/dir/new.txt", files["/dir/new.txt"], 0644)
+	converted := 0
+	for name, data := range files {
+		if raw, _ := afero.ReadFile(backing, name); !bytes.Equal(raw, data) {
+			converted++
+		}
+	}
+	if converted != 1 {
+		t.Errorf("Expected one converted file, got %d", converted)
+	}
+
+	// Another filesystem serving the tree sees the progress of Migrate
+	other := newFs(backing)
+	check(other)
+	if err := trfs.Migrate(fs); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+	check(other)
+	check(naclfs.New(16, Key("migrate"), backing, trfs.WithRules(trfs.Exclude("*.log"))))
+	for name, data := range files {
+		raw, _ := afero.ReadFile(backing, name)
+		if bytes.Equal(raw, data) != (name == "/skip.log") {
+			t.Errorf("Unexpected backing contents of %s: %q", name, raw)
+		}
+	}
+	if infos, _ := afero.ReadDir(fs, "/"); len(infos) != 3 {
+		t.Errorf("Checkpoint should be hidden: %v", infos)
+	}
+	if err := trfs.Migrate(naclfs.New(16, Key("migrate"), backing)); err == nil {
+		t.Errorf("Migrate should require WithMigration")
+	}
+}
+
+// Relative names find the progress recorded by rooted backing paths
+func TestMigrateRelativeNames(t *testing.T) {
+	base := afero.NewMemMapFs()
+	afero.WriteFile(base, "/tree/a.txt", []byte("first file"), 0644)
+	afero.WriteFile(base, "/tree/b.txt", []byte("second file"), 0644)
+	newFs := func(backing afero.Fs) afero.Fs {
+		return naclfs.New(16, Key("migrate"), afero.NewBasePathFs(backing, "/tree"), trfs.WithMigration())
+	}
+	if err := trfs.Migrate(newFs(&failingRenameFs{base, 1})); err == nil {
+		t.Fatalf("Migration should have been interrupted")
+	}
+	fs := newFs(base)
+	for _, name := range []string{"/a.txt", "a.txt", "/b.txt", "b.txt"} {
+		d, err := afero.ReadFile(fs, name)
+		if err != nil || (string(d) != "first file" && string(d) != "second file") {
+			t.Errorf("Unexpected contents of %s: %q, %v", name, d, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package trfs
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+/*
+NameTransformer encrypts single path components. Encryption has to be
+deterministic for a given name and IV, so names can be looked up. The
+result must be usable as a file name on the backing filesystem and must
+not start with a dot.
+*/
+type NameTransformer interface {
+	EncryptName(name string, iv []byte) (string, error)
+	DecryptName(name string, iv []byte) (string, error)
+}
+
+/*
+WithNameTransformer encrypts every file and directory name with the given
+name transformer. Each backing directory holds a random IV that is used
+for the names of its entries, so equal names in different directories
+encrypt differently.
+*/
+func WithNameTransformer(names NameTransformer) Option {
+	return func(fs *trfs) {
+		fs.names = names
+	}
+}
+
+const (
+	dirIVName = internalPrefix + "diriv"
+	dirIVSize = 16
+)
+
+var (
+	errMissingDirIV  = fmt.Errorf("missing directory IV")
+	errOutsideOfRoot = fmt.Errorf("path leaves the root of the filesystem")
+)
+
+// Splits a cleaned path into its root and components
+func splitPath(name string) (string, []string) {
+	root := "."
+	if filepath.IsAbs(name) {
+		root = string(filepath.Separator)
+		name = strings.TrimLeft(name, string(filepath.Separator))
+	}
+	if name == "" || name == "." {
+		return root, nil
+	}
+	return root, strings.Split(name, string(filepath.Separator))
+}
+
+/*
+Translates a path to the path of the backing file, encrypting each
+component if name encryption is enabled
+*/
+func (fs *trfs) backingPath(name string) (string, error) {
+	name = filepath.Clean(name)
+	if fs.names == nil {
+		return name, nil
+	}
+	dir, components := splitPath(name)
+	for _, c := range components {
+		enc, err := fs.backingName(dir, c)
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(dir, enc)
+	}
+	return dir, nil
+}
+
+// Encrypts a name for an entry of the given backing directory
+func (fs *trfs) encryptName(dir, name string) (string, error) {
+	if name == ".." {
+		return "", errOutsideOfRoot
+	}
+	iv, err := fs.dirIV(dir)
+	if err != nil {
+		return "", err
+	}
+	return fs.names.EncryptName(name, iv)
+}
+
+// Decrypts the name of an entry of the given backing directory
+func (fs *trfs) decryptName(dir, name string) (string, error) {
+	iv, err := fs.dirIV(dir)
+	if err != nil {
+		return "", err
+	}
+	return fs.names.DecryptName(name, iv)
+}
+
+/*
+Returns the IV of a backing directory. The IV of the root directory is
+created on first use.
+*/
+func (fs *trfs) dirIV(dir string) ([]byte, error) {
+	fs.ivMu.Lock()
+	defer fs.ivMu.Unlock()
+	if iv, ok := fs.dirIVs[dir]; ok {
+		return iv, nil
+	}
+	iv, err := afero.ReadFile(fs.Fs, filepath.Join(dir, dirIVName))
+	if os.IsNotExist(err) && !fs.readOnly && (dir == "." || dir == string(filepath.Separator)) {
+		iv, err = fs.writeDirIV(dir)
+	}
+	if os.IsNotExist(err) {
+		return nil, errMissingDirIV
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != dirIVSize {
+		return nil, fmt.Errorf("Invalid directory IV in %s", dir)
+	}
+	fs.dirIVs[dir] = iv
+	return iv, nil
+}
+
+func (fs *trfs) writeDirIV(dir string) ([]byte, error) {
+	iv := make([]byte, dirIVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	f, err := fs.Fs.OpenFile(filepath.Join(dir, dirIVName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0444)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(iv)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return iv, err
+}
+
+// Creates a backing directory along with its IV
+func (fs *trfs) mkdir(name, path string, perm os.FileMode) error {
+	if err := fs.Fs.Mkdir(path, perm); err != nil {
+		return err
+	}
+	if fs.names == nil {
+		return fs.notify(nil, Event{Op: EventCreate, Name: name})
+	}
+	_, err := fs.writeDirIV(path)
+	if err == nil {
+		err = fs.storeLongName(name, path)
+	}
+	if err != nil {
+		fs.removeDir(path)
+		return err
+	}
+	return fs.notify(nil, Event{Op: EventCreate, Name: name})
+}
+
+// Drops cached IVs of a removed or renamed backing directory and its children
+func (fs *trfs) forgetDirIVs(path string) {
+	fs.ivMu.Lock()
+	defer fs.ivMu.Unlock()
+	prefix := path + string(filepath.Separator)
+	for dir := range fs.dirIVs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			delete(fs.dirIVs, dir)
+		}
+	}
+}
+
+// Replaces backing paths in errors with the plaintext name
+func pathError(err error, name string) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return &os.PathError{Op: e.Op, Path: name, Err: e.Err}
+	}
+	return err
+}
+
+func linkError(err error, oldname, newname string) error {
+	switch e := err.(type) {
+	case *os.LinkError:
+		return &os.LinkError{Op: e.Op, Old: oldname, New: newname, Err: e.Err}
+	case *os.PathError:
+		return &os.PathError{Op: e.Op, Path: oldname, Err: e.Err}
+	}
+	return err
+}
+
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i *namedFileInfo) Name() string {
+	return i.name
+}
@@ -0,0 +1,84 @@
+package trfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+)
+
+func backingNames(t *testing.T, backing afero.Fs) []string {
+	var names []string
+	afero.Walk(backing, "/", func(path string, info os.FileInfo, err error) error {
+		names = append(names, path)
+		return err
+	})
+	return names
+}
+
+func TestNameEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backing := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	fs := naclfs.New(16, Key("names"), backing, naclfs.WithNameEncryption(Key("names")))
+
+	if err := fs.MkdirAll("/secret/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/secret/dir/file.txt", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	afero.WriteFile(fs, "/secret/other.txt", []byte("other"), 0644)
+
+	for _, n := range backingNames(t, backing) {
+		if strings.Contains(n, "secret") || strings.Contains(n, ".txt") {
+			t.Errorf("Backing path %q leaks plaintext name", n)
+		}
+	}
+
+	names, err := afero.ReadDir(fs, "/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, info := range names {
+		found = append(found, info.Name())
+	}
+	sort.Strings(found)
+	if strings.Join(found, ",") != "dir,other.txt" {
+		t.Errorf("Unexpected directory entries %v", found)
+	}
+
+	if err := fs.Rename("/secret/dir/file.txt", "/secret/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := afero.ReadFile(fs, "/secret/moved.txt"); err != nil || string(d) != "content" {
+		t.Errorf("Unexpected contents after rename %q, %v", d, err)
+	}
+	info, err := fs.Stat("/secret/moved.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "moved.txt" || info.Size() != 7 {
+		t.Errorf("Unexpected stat result %s, %d", info.Name(), info.Size())
+	}
+
+	if err := fs.Remove("/secret/dir"); err != nil {
+		t.Errorf("Could not remove empty directory: %v", err)
+	}
+	if err := fs.Remove("/secret"); err == nil {
+		t.Errorf("Removing a non-empty directory should fail")
+	}
+	if _, err := fs.Stat("/secret/missing"); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error, got %v", err)
+	} else if !strings.Contains(err.Error(), "/secret/missing") {
+		t.Errorf("Error should contain the plaintext path: %v", err)
+	}
+}
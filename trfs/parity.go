@@ -0,0 +1,231 @@
+package trfs
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile"
+	"github.com/tobiash/go-transformfile/trfs/parity"
+)
+
+const parityPrefix = internalPrefix + "parity."
+
+/*
+WithParity stores Reed-Solomon parity for every dataShards blocks of a file
+in a sidecar file. When a block fails to decode, it is rebuilt from the
+other blocks of its group and the parity, tolerating up to parityShards
+damaged blocks per group. Parity is updated after each block write, so a
+crash between the two can leave the parity of a single group stale.
+Panics if the numbers of shards are invalid.
+*/
+func WithParity(dataShards, parityShards int) Option {
+	enc, err := parity.NewEncoder(dataShards, parityShards)
+	if err != nil {
+		panic(err)
+	}
+	return func(fs *trfs) {
+		fs.parity = enc
+	}
+}
+
+func (fs *trfs) parityName(path string) string {
+	return fs.sidecarName(path, parityPrefix)
+}
+
+// Reads the data shards of a group, padding missing data with zeros
+func (fs *trfs) readDataShards(f afero.File, group int64) ([][]byte, error) {
+	bs := fs.encodedBlockSize()
+	d := int64(fs.parity.DataShards())
+	shards := make([][]byte, fs.parity.DataShards()+fs.parity.ParityShards())
+	for i := int64(0); i < d; i++ {
+		shards[i] = make([]byte, bs)
+		_, err := f.ReadAt(shards[i], (group*d+i)*bs)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+// Recomputes the parity of all groups overlapping the given range of the backing file
+func (fs *trfs) updateParity(name string, off, length int64) error {
+	if fs.parity == nil || length <= 0 {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.writeParity(name, off, length)
+}
+
+func (fs *trfs) writeParity(name string, off, length int64) error {
+	bs := fs.encodedBlockSize()
+	d := int64(fs.parity.DataShards())
+	p := int64(fs.parity.ParityShards())
+	f, err := fs.openDataFile(name, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	side, err := fs.Fs.OpenFile(fs.parityName(name), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer side.Close()
+	for group := off / bs / d; group <= (off+length-1)/bs/d; group++ {
+		shards, err := fs.readDataShards(f, group)
+		if err != nil {
+			return errors.Wrap(err, "Error reading blocks for parity")
+		}
+		for i := d; i < d+p; i++ {
+			shards[i] = make([]byte, bs)
+		}
+		if err := fs.parity.Encode(shards); err != nil {
+			return err
+		}
+		for i := int64(0); i < p; i++ {
+			if _, err := side.WriteAt(shards[d+i], (group*p+i)*bs); err != nil {
+				return errors.Wrap(err, "Error writing parity")
+			}
+		}
+	}
+	return nil
+}
+
+// Drops parity of groups beyond the new size and updates the last group
+func (fs *trfs) truncateParity(name string, size int64) error {
+	if fs.parity == nil {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	bs := fs.encodedBlockSize()
+	groupSize := bs * int64(fs.parity.DataShards())
+	groups := size / groupSize
+	if size%groupSize > 0 {
+		groups++
+	}
+	side, err := fs.Fs.OpenFile(fs.parityName(name), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	err = side.Truncate(groups * int64(fs.parity.ParityShards()) * bs)
+	if closeErr := side.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || size == 0 {
+		return err
+	}
+	return fs.writeParity(name, size-1, 1)
+}
+
+/*
+Rebuilds a damaged block of the backing file from parity and writes it
+back in place
+*/
+func (fs *trfs) repair(name string, block int64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	bs := fs.encodedBlockSize()
+	d := int64(fs.parity.DataShards())
+	p := int64(fs.parity.ParityShards())
+	group := block / d
+
+	f, err := fs.openDataFile(name, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	shards, err := fs.readDataShards(f, group)
+	if err != nil {
+		return err
+	}
+	side, err := fs.Fs.Open(fs.parityName(name))
+	if err != nil {
+		return err
+	}
+	defer side.Close()
+	for i := int64(0); i < p; i++ {
+		shard := make([]byte, bs)
+		n, err := side.ReadAt(shard, (group*p+i)*bs)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if int64(n) == bs {
+			shards[d+i] = shard
+		}
+	}
+	shards[block%d] = nil
+	if err := fs.parity.Reconstruct(shards); err != nil {
+		return errors.Wrapf(err, "Error rebuilding block %d", block)
+	}
+	length := min(bs, info.Size()-block*bs)
+	if length <= 0 {
+		return nil
+	}
+	_, err = f.WriteAt(shards[block%d][:length], block*bs)
+	return err
+}
+
+/*
+Tries to repair the block that caused err, unless it has been tried
+before. Returns true if the operation should be retried.
+*/
+func (f *file) repair(err error, tried map[int64]bool) bool {
+	if f.fs.parity == nil || f.fs.readOnly {
+		return false
+	}
+	blockErr, ok := errors.Cause(err).(*transformfile.BlockError)
+	if !ok || tried[blockErr.Block] {
+		return false
+	}
+	tried[blockErr.Block] = true
+	path := f.path
+	if shared, ok := f.File.(*sharedFile); ok {
+		path = shared.path()
+	}
+	return f.fs.repair(path, blockErr.Block) == nil
+}
+
+// Reads, retrying after repairing damaged blocks
+func (f *file) read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	for tried := make(map[int64]bool); err != nil && f.repair(err, tried); {
+		var m int
+		m, err = f.File.Read(p[n:])
+		n += m
+	}
+	return n, err
+}
+
+func (f *file) readAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	for tried := make(map[int64]bool); err != nil && f.repair(err, tried); {
+		n, err = f.File.ReadAt(p, off)
+	}
+	return n, err
+}
+
+// Writes, retrying after repairing damaged blocks that are rewritten
+func (f *file) write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	for tried := make(map[int64]bool); err != nil && f.repair(err, tried); {
+		var m int
+		m, err = f.File.Write(p[n:])
+		n += m
+	}
+	return n, err
+}
+
+func (f *file) writeAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	for tried := make(map[int64]bool); err != nil && f.repair(err, tried); {
+		n, err = f.File.WriteAt(p, off)
+	}
+	return n, err
+}
@@ -0,0 +1,235 @@
+/*
+Package parity implements systematic Reed-Solomon erasure coding over
+GF(2^8). Data shards are stored unchanged, parity shards are computed using
+a Cauchy matrix, so any combination of up to parityShards lost shards can
+be rebuilt from the remaining ones.
+*/
+package parity
+
+import (
+	"fmt"
+)
+
+var (
+	/* ErrTooFewShards is returned when not enough shards are left for reconstruction */
+	ErrTooFewShards     = fmt.Errorf("too few shards for reconstruction")
+	errShardCount       = fmt.Errorf("unexpected number of shards")
+	errShardSize        = fmt.Errorf("shards differ in size")
+	errInvalidShardNums = fmt.Errorf("invalid number of data or parity shards")
+)
+
+/*
+Encoder computes and rebuilds parity shards for a fixed number of data
+and parity shards
+*/
+type Encoder struct {
+	dataShards   int
+	parityShards int
+	// Rows of the encoding matrix below the identity part
+	parity [][]byte
+}
+
+/*
+NewEncoder creates an encoder. dataShards + parityShards must not exceed 256.
+*/
+func NewEncoder(dataShards, parityShards int) (*Encoder, error) {
+	if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > 256 {
+		return nil, errInvalidShardNums
+	}
+	e := &Encoder{dataShards, parityShards, make([][]byte, parityShards)}
+	for i := range e.parity {
+		e.parity[i] = make([]byte, dataShards)
+		for j := range e.parity[i] {
+			// Cauchy matrix with x_i = dataShards + i and y_j = j
+			e.parity[i][j] = gfInv(byte(dataShards+i) ^ byte(j))
+		}
+	}
+	return e, nil
+}
+
+// DataShards returns the number of data shards
+func (e *Encoder) DataShards() int {
+	return e.dataShards
+}
+
+// ParityShards returns the number of parity shards
+func (e *Encoder) ParityShards() int {
+	return e.parityShards
+}
+
+// Returns the row of the encoding matrix for the given shard
+func (e *Encoder) row(shard int) []byte {
+	if shard >= e.dataShards {
+		return e.parity[shard-e.dataShards]
+	}
+	r := make([]byte, e.dataShards)
+	r[shard] = 1
+	return r
+}
+
+func (e *Encoder) checkShards(shards [][]byte, allowMissing bool) (int, error) {
+	if len(shards) != e.dataShards+e.parityShards {
+		return 0, errShardCount
+	}
+	size := -1
+	for _, s := range shards {
+		if s == nil && allowMissing {
+			continue
+		}
+		if size >= 0 && len(s) != size {
+			return 0, errShardSize
+		}
+		size = len(s)
+	}
+	if size < 0 {
+		return 0, ErrTooFewShards
+	}
+	return size, nil
+}
+
+/*
+Encode computes the parity shards. shards must contain dataShards data
+shards followed by parityShards shards to store the parity in, all of
+equal size.
+*/
+func (e *Encoder) Encode(shards [][]byte) error {
+	if _, err := e.checkShards(shards, false); err != nil {
+		return err
+	}
+	for i, row := range e.parity {
+		mulRows(row, shards[:e.dataShards], shards[e.dataShards+i])
+	}
+	return nil
+}
+
+/*
+Reconstruct rebuilds missing shards, which are marked by nil entries.
+Rebuilt shards are allocated and stored in shards.
+*/
+func (e *Encoder) Reconstruct(shards [][]byte) error {
+	size, err := e.checkShards(shards, true)
+	if err != nil {
+		return err
+	}
+	var present []int
+	for i, s := range shards {
+		if s != nil && len(present) < e.dataShards {
+			present = append(present, i)
+		}
+	}
+	if len(present) < e.dataShards {
+		return ErrTooFewShards
+	}
+
+	// Invert the rows of the present shards to get back the data
+	m := make([][]byte, e.dataShards)
+	input := make([][]byte, e.dataShards)
+	for i, shard := range present {
+		m[i] = append([]byte(nil), e.row(shard)...)
+		input[i] = shards[shard]
+	}
+	inv, err := invert(m)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < e.dataShards; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			mulRows(inv[i], input, shards[i])
+		}
+	}
+	for i, row := range e.parity {
+		if shards[e.dataShards+i] == nil {
+			shards[e.dataShards+i] = make([]byte, size)
+			mulRows(row, shards[:e.dataShards], shards[e.dataShards+i])
+		}
+	}
+	return nil
+}
+
+// Computes out = sum(row[j] * in[j])
+func mulRows(row []byte, in [][]byte, out []byte) {
+	for k := range out {
+		out[k] = 0
+	}
+	for j, c := range row {
+		if c == 0 {
+			continue
+		}
+		for k, b := range in[j] {
+			out[k] ^= gfMul(c, b)
+		}
+	}
+}
+
+// Inverts a square matrix using Gauss-Jordan elimination
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if m[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		scale := gfInv(m[col][col])
+		for k := 0; k < n; k++ {
+			m[col][k] = gfMul(m[col][k], scale)
+			inv[col][k] = gfMul(inv[col][k], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			f := m[r][col]
+			for k := 0; k < n; k++ {
+				m[r][k] ^= gfMul(f, m[col][k])
+				inv[r][k] ^= gfMul(f, inv[col][k])
+			}
+		}
+	}
+	return inv, nil
+}
+
+// Log and exp tables for GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
@@ -0,0 +1,58 @@
+package parity
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestReconstruct(t *testing.T) {
+	var reconstructTests = []struct {
+		data, parity int
+		missing      []int
+		expectedErr  error
+	}{
+		{4, 2, []int{0}, nil},
+		{4, 2, []int{1, 3}, nil},
+		{4, 2, []int{2, 5}, nil},
+		{4, 2, []int{4, 5}, nil},
+		{10, 3, []int{0, 9, 11}, nil},
+		{4, 2, []int{0, 1, 2}, ErrTooFewShards},
+	}
+	for _, tt := range reconstructTests {
+		e, err := NewEncoder(tt.data, tt.parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards := make([][]byte, tt.data+tt.parity)
+		for i := range shards {
+			shards[i] = make([]byte, 64)
+			if i < tt.data {
+				rand.Read(shards[i])
+			}
+		}
+		if err := e.Encode(shards); err != nil {
+			t.Fatal(err)
+		}
+		original := make([][]byte, len(shards))
+		for i, s := range shards {
+			original[i] = append([]byte(nil), s...)
+		}
+		for _, m := range tt.missing {
+			shards[m] = nil
+		}
+		err = e.Reconstruct(shards)
+		if err != tt.expectedErr {
+			t.Errorf("Unexpected error %v, expected %v", err, tt.expectedErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for i := range shards {
+			if !bytes.Equal(shards[i], original[i]) {
+				t.Errorf("Shard %d was not reconstructed correctly (missing %v)", i, tt.missing)
+			}
+		}
+	}
+}
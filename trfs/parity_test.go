@@ -0,0 +1,56 @@
+package trfs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func TestParityRepair(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs := naclfs.New(16, Key("parity"), backing, trfs.WithParity(4, 2))
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10)
+	if err := afero.WriteFile(fs, "file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := afero.ReadFile(backing, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip bits in two blocks of different groups
+	raw[60] ^= 0x01
+	raw[5*56+30] ^= 0x80
+	if err := afero.WriteFile(backing, "file", raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := afero.ReadFile(fs, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("Damaged blocks were not rebuilt")
+	}
+
+	// The repaired blocks are written back
+	plain := naclfs.New(16, Key("parity"), backing)
+	if read, err := afero.ReadFile(plain, "file"); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("Repaired blocks were not written back: %v", err)
+	}
+}
+
+func TestParityWithoutRepair(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs := naclfs.New(16, Key("parity"), backing)
+	afero.WriteFile(fs, "file", bytes.Repeat([]byte("x"), 64), 0644)
+	raw, _ := afero.ReadFile(backing, "file")
+	raw[60] ^= 0x01
+	afero.WriteFile(backing, "file", raw, 0644)
+	if _, err := afero.ReadFile(fs, "file"); err == nil {
+		t.Errorf("Expected decode error without parity")
+	}
+}
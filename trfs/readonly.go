@@ -0,0 +1,32 @@
+package trfs
+
+import "os"
+
+/*
+WithReadOnly serves the tree without ever writing to the backing
+filesystem. Methods of the filesystem and its files that would change the
+tree fail with os.ErrPermission, backing files are only opened for reading
+and closing files does not sync them. Damaged blocks are not repaired from
+parity.
+*/
+func WithReadOnly() Option {
+	return func(fs *trfs) {
+		fs.readOnly = true
+	}
+}
+
+// Fails with os.ErrPermission if the filesystem is read-only
+func (fs *trfs) checkWritable(op, name string) error {
+	if fs.readOnly {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+// Like checkWritable, for operations on two names
+func (fs *trfs) checkLinkWritable(op, oldname, newname string) error {
+	if fs.readOnly {
+		return &os.LinkError{Op: op, Old: oldname, New: newname, Err: os.ErrPermission}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package trfs_test
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+// Counts the calls that could change the backing filesystem
+type writeCountingFs struct {
+	afero.Fs
+	writes int64
+}
+
+func (fs *writeCountingFs) count() {
+	atomic.AddInt64(&fs.writes, 1)
+}
+
+func (fs *writeCountingFs) Create(name string) (afero.File, error) {
+	fs.count()
+	return fs.Fs.Create(name)
+}
+
+func (fs *writeCountingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		fs.count()
+	}
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &writeCountingFile{f, fs}, nil
+}
+
+func (fs *writeCountingFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *writeCountingFs) Mkdir(name string, perm os.FileMode) error {
+	fs.count()
+	return fs.Fs.Mkdir(name, perm)
+}
+
+func (fs *writeCountingFs) MkdirAll(name string, perm os.FileMode) error {
+	fs.count()
+	return fs.Fs.MkdirAll(name, perm)
+}
+
+func (fs *writeCountingFs) Remove(name string) error {
+	fs.count()
+	return fs.Fs.Remove(name)
+}
+
+func (fs *writeCountingFs) RemoveAll(name string) error {
+	fs.count()
+	return fs.Fs.RemoveAll(name)
+}
+
+func (fs *writeCountingFs) Rename(oldname, newname string) error {
+	fs.count()
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func (fs *writeCountingFs) Chmod(name string, mode os.FileMode) error {
+	fs.count()
+	return fs.Fs.Chmod(name, mode)
+}
+
+func (fs *writeCountingFs) Chtimes(name string, atime, mtime time.Time) error {
+	fs.count()
+	return fs.Fs.Chtimes(name, atime, mtime)
+}
+
+type writeCountingFile struct {
+	afero.File
+	fs *writeCountingFs
+}
+
+func (f *writeCountingFile) Write(p []byte) (int, error) {
+	f.fs.count()
+	return f.File.Write(p)
+}
+
+func (f *writeCountingFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.count()
+	return f.File.WriteAt(p, off)
+}
+
+func (f *writeCountingFile) WriteString(s string) (int, error) {
+	f.fs.count()
+	return f.File.WriteString(s)
+}
+
+func (f *writeCountingFile) Truncate(size int64) error {
+	f.fs.count()
+	return f.File.Truncate(size)
+}
+
+func (f *writeCountingFile) Sync() error {
+	f.fs.count()
+	return f.File.Sync()
+}
+
+func TestReadOnly(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	opts := []trfs.Option{naclfs.WithNameEncryption(Key("ro")), trfs.WithParity(2, 1)}
+	fs := naclfs.New(16, Key("ro"), backing, opts...)
+	fs.MkdirAll("/dir", 0755)
+	afero.WriteFile(fs, "/dir/file.txt", []byte("read only contents"), 0644)
+	fs.(trfs.Attributer).SetAttr("/dir/file.txt", "user.tag", []byte("value"))
+
+	counting := &writeCountingFs{Fs: backing}
+	fs = naclfs.New(16, Key("ro"), counting, append(opts, trfs.WithReadOnly())...)
+	if d, err := afero.ReadFile(fs, "/dir/file.txt"); err != nil || string(d) != "read only contents" {
+		t.Errorf("Unexpected contents %q, %v", d, err)
+	}
+	if names, err := afero.ReadDir(fs, "/dir"); err != nil || len(names) != 1 {
+		t.Errorf("Unexpected listing %v, %v", names, err)
+	}
+	if v, err := fs.(trfs.Attributer).GetAttr("/dir/file.txt", "user.tag"); err != nil || string(v) != "value" {
+		t.Errorf("Unexpected attribute %q, %v", v, err)
+	}
+
+	f, err := fs.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.(trfs.Locker).RLock(); err != nil {
+		t.Errorf("Could not lock: %v", err)
+	}
+	for name, err := range map[string]error{
+		"write":    second(f.Write([]byte("x"))),
+		"writeat":  second(f.WriteAt([]byte("x"), 0)),
+		"truncate": f.Truncate(0),
+	} {
+		if !os.IsPermission(err) {
+			t.Errorf("Expected %s to be denied, got %v", name, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Error(err)
+	}
+
+	_, createErr := fs.Create("/new")
+	_, openErr := fs.OpenFile("/dir/file.txt", os.O_RDWR, 0)
+	_, snapErr := fs.(trfs.Snapshotter).Snapshot("/dir/file.txt")
+	for name, err := range map[string]error{
+		"create":     createErr,
+		"openfile":   openErr,
+		"mkdir":      fs.Mkdir("/new", 0755),
+		"mkdirall":   fs.MkdirAll("/new/dir", 0755),
+		"remove":     fs.Remove("/dir/file.txt"),
+		"removeall":  fs.RemoveAll("/dir"),
+		"rename":     fs.Rename("/dir", "/other"),
+		"chmod":      fs.Chmod("/dir/file.txt", 0600),
+		"chtimes":    fs.Chtimes("/dir/file.txt", time.Now(), time.Now()),
+		"setattr":    fs.(trfs.Attributer).SetAttr("/dir/file.txt", "user.tag", nil),
+		"removeattr": fs.(trfs.Attributer).RemoveAttr("/dir/file.txt", "user.tag"),
+		"snapshot":   snapErr,
+		"symlink":    fs.(afero.Symlinker).SymlinkIfPossible("/dir/file.txt", "/link"),
+	} {
+		if !os.IsPermission(err) {
+			t.Errorf("Expected %s to be denied, got %v", name, err)
+		}
+	}
+	if counting.writes != 0 {
+		t.Errorf("Backing filesystem saw %d writes", counting.writes)
+	}
+}
+
+func second(_ int, err error) error {
+	return err
+}
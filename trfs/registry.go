@@ -0,0 +1,270 @@
+package trfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tobiash/go-transformfile"
+)
+
+/*
+State shared by all handles of a transformed file that is open. Handles
+only keep their own offset, all reads and writes go through one
+transformed file, so they see each others changes immediately like
+handles of one inode do.
+*/
+type openFile struct {
+	mu      sync.Mutex
+	inner   transformfile.File
+	backing *backingFile
+	// The inner file has been opened for writing
+	writable bool
+	refs     int
+}
+
+// Handle to a shared open file
+type sharedFile struct {
+	fs     *trfs
+	entry  *openFile
+	offset int64
+	// Every write goes to the end of file
+	append bool
+	closed bool
+}
+
+/*
+Returns a handle to the open file at path. inner is used if the file is
+not open yet, or if it is only open for reading and inner is writable.
+Otherwise inner is closed.
+*/
+func (fs *trfs) share(path string, inner transformfile.File, backing *backingFile, writable bool) *sharedFile {
+	fs.filesMu.Lock()
+	defer fs.filesMu.Unlock()
+	path = filepath.Clean(path)
+	entry, ok := fs.files[path]
+	if !ok {
+		entry = &openFile{inner: inner, backing: backing, writable: writable}
+		fs.files[path] = entry
+	} else {
+		entry.mu.Lock()
+		if writable && !entry.writable {
+			entry.inner.Close()
+			entry.inner, entry.backing, entry.writable = inner, backing, true
+		} else {
+			inner.Close()
+		}
+		entry.mu.Unlock()
+	}
+	entry.refs++
+	return &sharedFile{fs: fs, entry: entry}
+}
+
+func (fs *trfs) release(entry *openFile) error {
+	fs.filesMu.Lock()
+	defer fs.filesMu.Unlock()
+	entry.refs--
+	if entry.refs > 0 {
+		return nil
+	}
+	for path, e := range fs.files {
+		if e == entry {
+			delete(fs.files, path)
+		}
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return entry.inner.Close()
+}
+
+/*
+Detaches open files and locks at or below path from it, so files created later at
+the same path get their own state
+*/
+func (fs *trfs) forgetOpenFiles(path string) {
+	fs.filesMu.Lock()
+	defer fs.filesMu.Unlock()
+	prefix := path + string(filepath.Separator)
+	for p := range fs.files {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(fs.files, p)
+		}
+	}
+	for p := range fs.locks {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(fs.locks, p)
+		}
+	}
+}
+
+// Moves open files and locks at or below oldpath to newpath
+func (fs *trfs) renameOpenFiles(oldpath, newpath string) {
+	fs.filesMu.Lock()
+	defer fs.filesMu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	prefix := oldpath + string(filepath.Separator)
+	moved := make(map[string]*openFile)
+	for p, entry := range fs.files {
+		if p != oldpath && !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		delete(fs.files, p)
+		p = newpath + p[len(oldpath):]
+		entry.mu.Lock()
+		entry.backing.name = p
+		entry.mu.Unlock()
+		moved[p] = entry
+	}
+	for p, entry := range moved {
+		fs.files[p] = entry
+	}
+	tables := make(map[string]*lockTable)
+	for p, t := range fs.locks {
+		if p == oldpath || strings.HasPrefix(p, prefix) {
+			delete(fs.locks, p)
+			tables[newpath+p[len(oldpath):]] = t
+		}
+	}
+	for p, t := range tables {
+		fs.locks[p] = t
+	}
+}
+
+// Locks the shared state, unless the handle has been closed
+func (f *sharedFile) lock(op string) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.Name(), Err: os.ErrClosed}
+	}
+	f.entry.mu.Lock()
+	return nil
+}
+
+// Current path of the backing file
+func (f *sharedFile) path() string {
+	f.entry.mu.Lock()
+	defer f.entry.mu.Unlock()
+	return f.entry.backing.name
+}
+
+func (f *sharedFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.Name(), Err: os.ErrClosed}
+	}
+	f.closed = true
+	return f.fs.release(f.entry)
+}
+
+func (f *sharedFile) Read(p []byte) (int, error) {
+	if err := f.lock("read"); err != nil {
+		return 0, err
+	}
+	defer f.entry.mu.Unlock()
+	n, err := f.entry.inner.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *sharedFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.lock("read"); err != nil {
+		return 0, err
+	}
+	defer f.entry.mu.Unlock()
+	return f.entry.inner.ReadAt(p, off)
+}
+
+func (f *sharedFile) Write(p []byte) (int, error) {
+	if err := f.lock("write"); err != nil {
+		return 0, err
+	}
+	defer f.entry.mu.Unlock()
+	if f.append {
+		end, err := f.entry.inner.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		f.offset = end
+	}
+	n, err := f.entry.inner.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *sharedFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.lock("write"); err != nil {
+		return 0, err
+	}
+	defer f.entry.mu.Unlock()
+	return f.entry.inner.WriteAt(p, off)
+}
+
+func (f *sharedFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *sharedFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.lock("seek"); err != nil {
+		return 0, err
+	}
+	defer f.entry.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		end, err := f.entry.inner.Seek(0, io.SeekEnd)
+		if err != nil {
+			return f.offset, err
+		}
+		offset += end
+	default:
+		return f.offset, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return f.offset, transformfile.ErrInvalidSeek
+	}
+	f.offset = offset
+	return f.offset, nil
+}
+
+func (f *sharedFile) Truncate(size int64) error {
+	if err := f.lock("truncate"); err != nil {
+		return err
+	}
+	defer f.entry.mu.Unlock()
+	return f.entry.inner.Truncate(size)
+}
+
+func (f *sharedFile) Sync() error {
+	if err := f.lock("sync"); err != nil {
+		return err
+	}
+	defer f.entry.mu.Unlock()
+	return f.entry.inner.Sync()
+}
+
+func (f *sharedFile) Stat() (os.FileInfo, error) {
+	if err := f.lock("stat"); err != nil {
+		return nil, err
+	}
+	defer f.entry.mu.Unlock()
+	return f.entry.inner.Stat()
+}
+
+func (f *sharedFile) Name() string {
+	f.entry.mu.Lock()
+	defer f.entry.mu.Unlock()
+	return f.entry.inner.Name()
+}
+
+func (f *sharedFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.Name(), Err: os.ErrInvalid}
+}
+
+func (f *sharedFile) Readdirnames(n int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdirnames", Path: f.Name(), Err: os.ErrInvalid}
+}
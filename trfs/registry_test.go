@@ -0,0 +1,118 @@
+package trfs_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+)
+
+func TestSharedHandles(t *testing.T) {
+	fs := naclfs.New(16, Key("shared"), afero.NewMemMapFs())
+	w, err := fs.Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r, err := fs.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	w.Write([]byte("first"))
+	b := make([]byte, 16)
+	n, err := r.Read(b)
+	if err != nil || string(b[:n]) != "first" {
+		t.Errorf("Write not visible to other handle: %q, %v", b[:n], err)
+	}
+	w.Write([]byte(" second"))
+	n, err = r.Read(b)
+	if err != nil || string(b[:n]) != " second" {
+		t.Errorf("Handles do not keep their own offset: %q, %v", b[:n], err)
+	}
+	if _, err := r.Write([]byte("x")); err == nil {
+		t.Errorf("Writing through a read-only handle should fail")
+	}
+
+	if err := fs.Rename("/file", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(" third"))
+	if d, _ := afero.ReadFile(fs, "/moved"); string(d) != "first second third" {
+		t.Errorf("Unexpected contents after rename %q", d)
+	}
+}
+
+func TestSharedHandlesAppend(t *testing.T) {
+	fs := naclfs.New(16, Key("shared"), afero.NewMemMapFs())
+	var handles []afero.File
+	for i := 0; i < 2; i++ {
+		f, err := fs.OpenFile("/log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		handles = append(handles, f)
+	}
+	handles[0].Write([]byte("a1 "))
+	handles[1].Write([]byte("b1 "))
+	handles[0].Write([]byte("a2 "))
+	if d, _ := afero.ReadFile(fs, "/log"); string(d) != "a1 b1 a2 " {
+		t.Errorf("Unexpected contents %q", d)
+	}
+}
+
+func TestSharedHandlesConcurrent(t *testing.T) {
+	fs := naclfs.New(16, Key("shared"), afero.NewMemMapFs())
+	const writers, size = 8, 40
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		f, err := fs.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int, f afero.File) {
+			defer wg.Done()
+			defer f.Close()
+			// Regions of writers share blocks
+			f.WriteAt(bytes.Repeat([]byte{byte('a' + i)}, size), int64(i*size))
+		}(i, f)
+	}
+	wg.Wait()
+
+	f, err := fs.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := 0; i < writers; i++ {
+		b := make([]byte, size)
+		if _, err := io.ReadFull(f, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, bytes.Repeat([]byte{byte('a' + i)}, size)) {
+			t.Errorf("Region %d overwritten: %q", i, b)
+		}
+	}
+}
+
+func TestSharedHandlesRemove(t *testing.T) {
+	fs := naclfs.New(16, Key("shared"), afero.NewMemMapFs())
+	old, _ := fs.Create("/file")
+	defer old.Close()
+	old.Write([]byte("old"))
+	fs.Remove("/file")
+
+	f, _ := fs.Create("/file")
+	f.Write([]byte("new"))
+	f.Close()
+	if d, _ := afero.ReadFile(fs, "/file"); string(d) != "new" {
+		t.Errorf("New file shares state with removed one: %q", d)
+	}
+}
@@ -0,0 +1,147 @@
+package trfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+/*
+ErrRuleMismatch is returned by Rename if a file would move between a name
+that is transformed and one that is not
+*/
+var ErrRuleMismatch = fmt.Errorf("rename between transformed and untransformed names")
+
+/*
+Rule decides whether the file at the given path is transformed. ok is
+false if the rule does not apply to the path.
+*/
+type Rule func(name string) (transform bool, ok bool)
+
+/*
+WithRules selects the files that are transformed. Rules are evaluated in
+order and the first rule applying to a path decides. Files no rule applies
+to are transformed. Files that are not transformed are passed through to
+the backing filesystem unchanged, their names are still encrypted if name
+encryption is enabled. Renames moving a file between a transformed and an
+untransformed name fail with ErrRuleMismatch, as contents are not
+converted.
+*/
+func WithRules(rules ...Rule) Option {
+	return func(fs *trfs) {
+		fs.rules = append(fs.rules, rules...)
+	}
+}
+
+/*
+Include transforms files matching any of the glob patterns. Patterns
+without a path separator are matched against the base name, others against
+the full path from the root of the filesystem. A leading separator is
+ignored in patterns and names, so "public/*" and "/public/*" both match
+"public/index.html" and "/public/index.html". Panics if a pattern is
+malformed.
+*/
+func Include(patterns ...string) Rule {
+	return globRule(true, patterns)
+}
+
+/*
+Exclude passes files matching any of the glob patterns through unchanged.
+Patterns are matched like in Include.
+*/
+func Exclude(patterns ...string) Rule {
+	return globRule(false, patterns)
+}
+
+/*
+Predicate transforms the files for which fn returns true. It applies to
+all paths, so rules after it are never evaluated.
+*/
+func Predicate(fn func(name string) bool) Rule {
+	return func(name string) (bool, bool) {
+		return fn(name), true
+	}
+}
+
+func globRule(transform bool, patterns []string) Rule {
+	patterns = append([]string(nil), patterns...)
+	for i, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			panic(err)
+		}
+		patterns[i] = strings.TrimLeft(p, string(filepath.Separator))
+	}
+	return func(name string) (bool, bool) {
+		name = strings.TrimLeft(name, string(filepath.Separator))
+		for _, p := range patterns {
+			subject := name
+			if !strings.ContainsRune(p, filepath.Separator) {
+				subject = filepath.Base(name)
+			}
+			if ok, _ := filepath.Match(p, subject); ok {
+				return transform, true
+			}
+		}
+		return false, false
+	}
+}
+
+/*
+Returns whether the file at the given path is transformed. During a
+migration files are only transformed once they have been converted.
+*/
+func (fs *trfs) transforms(name string) bool {
+	name = filepath.Clean(name)
+	// Progress is recorded by rooted backing paths, which names are without name encryption
+	if fs.migration != nil && !fs.migration.converted(fs, filepath.Join(string(filepath.Separator), name)) {
+		return false
+	}
+	return fs.selected(name)
+}
+
+// Returns whether the rules select the file at the given path for transformation
+func (fs *trfs) selected(name string) bool {
+	for _, rule := range fs.rules {
+		if transform, ok := rule(name); ok {
+			return transform
+		}
+	}
+	return true
+}
+
+/*
+Checks that a rename keeps every file it moves transformed or not
+transformed, as contents are not converted by renaming
+*/
+func (fs *trfs) checkRenameRules(oldname, newname, oldpath string) error {
+	if len(fs.rules) == 0 && fs.migration == nil {
+		return nil
+	}
+	info, err := fs.lstat(oldpath)
+	if err != nil {
+		// Reported by the rename
+		return nil
+	}
+	if !info.IsDir() {
+		if isRegular(info) && fs.transforms(oldname) != fs.transforms(newname) {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: ErrRuleMismatch}
+		}
+		return nil
+	}
+	return afero.Walk(fs, oldname, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !isRegular(info) {
+			return err
+		}
+		rel, err := filepath.Rel(oldname, name)
+		if err != nil {
+			return err
+		}
+		if fs.transforms(name) != fs.transforms(filepath.Join(newname, rel)) {
+			return &os.LinkError{Op: "rename", Old: name, New: filepath.Join(newname, rel), Err: ErrRuleMismatch}
+		}
+		return nil
+	})
+}
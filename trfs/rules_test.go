@@ -0,0 +1,117 @@
+package trfs_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func TestRules(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs := naclfs.New(16, Key("rules"), backing, trfs.WithRules(
+		trfs.Exclude(".keep", "*.tar.gpg", "/public/*", "static/*"),
+		trfs.Predicate(func(name string) bool { return !strings.HasSuffix(name, ".plain") }),
+	))
+
+	var ruleTests = []struct {
+		name        string
+		transformed bool
+	}{
+		{"/data/file", true},
+		{"/data/.keep", false},
+		{"/data/archive.tar.gpg", false},
+		{"/public/logo.png", false},
+		{"/public/sub/logo.png", true},
+		{"public/icon.png", false},
+		{"/static/style.css", false},
+		{"static/script.js", false},
+		{"/data/notes.plain", false},
+	}
+	content := "some content of the file"
+	for _, tt := range ruleTests {
+		if err := afero.WriteFile(fs, tt.name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := afero.ReadFile(backing, tt.name)
+		if (string(raw) != content) != tt.transformed {
+			t.Errorf("%s: expected transformed=%v, backing contains %q", tt.name, tt.transformed, raw)
+		}
+		if d, err := afero.ReadFile(fs, tt.name); err != nil || string(d) != content {
+			t.Errorf("%s: unexpected contents %q, %v", tt.name, d, err)
+		}
+		info, err := fs.Stat(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(content)) {
+			t.Errorf("%s: unexpected size %d", tt.name, info.Size())
+		}
+	}
+
+	infos, err := afero.ReadDir(fs, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Size() != int64(len(content)) {
+			t.Errorf("Readdir %s: unexpected size %d", info.Name(), info.Size())
+		}
+	}
+}
+
+func TestRulesExcludedSnapshot(t *testing.T) {
+	fs := naclfs.New(16, Key("rules"), afero.NewMemMapFs(), trfs.WithRules(trfs.Exclude("*.keep")))
+	if err := afero.WriteFile(fs, "/f.keep", []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := fs.(trfs.Snapshotter).Snapshot("/f.keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("/f.keep", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("CHANGED!"), 0)
+	f.Close()
+	if d := readSnapshot(t, fs.(trfs.Snapshotter), "/f.keep", id); d != "original" {
+		t.Errorf("Unexpected snapshot contents %q", d)
+	}
+}
+
+func TestRulesRename(t *testing.T) {
+	fs := naclfs.New(16, Key("rules"), afero.NewMemMapFs(), trfs.WithRules(trfs.Exclude("*.keep", "/raw/*")))
+	afero.WriteFile(fs, "/a.keep", []byte("plain"), 0644)
+	afero.WriteFile(fs, "/dir/b", []byte("transformed"), 0644)
+
+	var renameTests = []struct {
+		oldname, newname string
+		ok               bool
+	}{
+		{"/a.keep", "/a", false},
+		{"/a.keep", "/b.keep", true},
+		{"/dir/b", "/dir/b.keep", false},
+		{"/dir/b", "/dir/c", true},
+		// Directories are only renamed if all files below them keep being transformed
+		{"/dir", "/raw", false},
+		{"/dir", "/other", true},
+	}
+	for _, tt := range renameTests {
+		err := fs.Rename(tt.oldname, tt.newname)
+		if tt.ok && err != nil {
+			t.Errorf("Rename %s to %s failed: %v", tt.oldname, tt.newname, err)
+		}
+		if !tt.ok {
+			if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != trfs.ErrRuleMismatch {
+				t.Errorf("Rename %s to %s: expected rule mismatch, got %v", tt.oldname, tt.newname, err)
+			}
+		}
+	}
+	if d, err := afero.ReadFile(fs, "/b.keep"); err != nil || string(d) != "plain" {
+		t.Errorf("Unexpected contents after rename %q, %v", d, err)
+	}
+}
@@ -0,0 +1,53 @@
+package trfs
+
+import (
+	"compress/flate"
+	"fmt"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile"
+)
+
+// ChainFsName is the name of filesystems opened by the trfs scheme
+const ChainFsName = "trfs"
+
+func init() {
+	transformfile.RegisterChain(ChainFsName, openChain)
+	transformfile.RegisterCodec(DeflateCodecName, openDeflate)
+}
+
+/*
+Opens a chain of codecs for transformfile.OpenFs with NewChainFs.
+Parameters are the block size, which has to be given, and readOnly for a
+read-only view.
+*/
+func openChain(backing afero.Fs, codecs []Codec, p *transformfile.Params) (afero.Fs, error) {
+	blockSize, err := p.Int("blockSize", 0)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("Invalid block size %d of %s", blockSize, p.Scheme)
+	}
+	readOnly, err := p.Bool("readOnly")
+	if err != nil {
+		return nil, err
+	}
+	var opts []Option
+	if readOnly {
+		opts = append(opts, WithReadOnly())
+	}
+	return NewChainFs(blockSize, ChainFsName, backing, codecs, opts...), nil
+}
+
+// Opens the deflate codec, the parameter level defaults to flate.DefaultCompression
+func openDeflate(p *transformfile.Params) (Codec, error) {
+	level, err := p.Int("level", flate.DefaultCompression)
+	if err != nil {
+		return Codec{}, err
+	}
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return Codec{}, fmt.Errorf("Invalid compression level %d of %s", level, p.Scheme)
+	}
+	return DeflateCodec(int(level)), nil
+}
@@ -0,0 +1,644 @@
+package trfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile"
+)
+
+/*
+Snapshotter is implemented by filesystems that can take point-in-time
+snapshots of single files. A snapshot shares unchanged blocks with the live
+file and only keeps copies of blocks overwritten since it was taken.
+*/
+type Snapshotter interface {
+	// Snapshot takes a new snapshot of the named file and returns its ID
+	Snapshot(name string) (string, error)
+	// Snapshots lists the snapshots of the named file, oldest first
+	Snapshots(name string) ([]SnapshotInfo, error)
+	// OpenSnapshot opens a snapshot of the named file for reading
+	OpenSnapshot(name, id string) (transformfile.File, error)
+	// RemoveSnapshot deletes a snapshot of the named file
+	RemoveSnapshot(name, id string) error
+}
+
+/*
+SnapshotInfo describes a snapshot of a file
+*/
+type SnapshotInfo struct {
+	ID      string
+	Created time.Time
+	// Size of the file at the time the snapshot was taken
+	Size int64
+}
+
+var (
+	/* ErrSnapshotNotFound is returned when the requested snapshot does not exist */
+	ErrSnapshotNotFound = fmt.Errorf("snapshot not found")
+	errNoSnapshotOfDir  = fmt.Errorf("cannot snapshot a directory")
+	errSnapshotReadOnly = fmt.Errorf("snapshot is read-only")
+)
+
+const (
+	snapshotPrefix     = internalPrefix + "snap."
+	snapshotMagic      = 0x54525331 // "TRS1"
+	snapshotHeaderSize = 20
+	snapshotRecordSize = 12
+)
+
+/*
+A snapshot is stored in a sidecar file next to the live file. It starts
+with a header
+
+	magic   uint32
+	created int64   unix time in nanoseconds
+	rawSize int64   size of the backing file when the snapshot was taken
+
+followed by copies of encoded blocks, each preceded by
+
+	block  int64
+	length uint32
+*/
+type snapshot struct {
+	id      string
+	path    string
+	created time.Time
+	rawSize int64
+	blocks  map[int64]snapshotBlock
+	end     int64
+}
+
+type snapshotBlock struct {
+	offset int64
+	length int64
+}
+
+func (fs *trfs) snapshotName(path, id string) string {
+	return fs.sidecarName(path, snapshotPrefix) + "." + id
+}
+
+// Loads the snapshots of the given file, fs.mu must be held
+func (fs *trfs) loadSnapshots(name string) ([]*snapshot, error) {
+	name = filepath.Clean(name)
+	if snaps, ok := fs.snapshots[name]; ok {
+		return snaps, nil
+	}
+	dir := filepath.Dir(name)
+	d, err := fs.Fs.Open(filepath.Clean(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(fs.sidecarName(name, snapshotPrefix)) + "."
+	var snaps []*snapshot
+	for _, n := range names {
+		if !strings.HasPrefix(n, prefix) || strings.Contains(n[len(prefix):], ".") {
+			continue
+		}
+		snap, err := fs.readSnapshot(filepath.Join(dir, n), n[len(prefix):])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading snapshot %s", n)
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].created.Before(snaps[j].created) })
+	fs.snapshots[name] = snaps
+	return snaps, nil
+}
+
+func (fs *trfs) readSnapshot(path, id string) (*snapshot, error) {
+	f, err := fs.Fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var h [snapshotHeaderSize]byte
+	if _, err := io.ReadFull(f, h[:]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(h[0:]) != snapshotMagic {
+		return nil, fmt.Errorf("Invalid snapshot header")
+	}
+	snap := &snapshot{
+		id:      id,
+		path:    path,
+		created: time.Unix(0, int64(binary.BigEndian.Uint64(h[4:]))),
+		rawSize: int64(binary.BigEndian.Uint64(h[12:])),
+		blocks:  make(map[int64]snapshotBlock),
+		end:     snapshotHeaderSize,
+	}
+	for {
+		var r [snapshotRecordSize]byte
+		_, err := f.ReadAt(r[:], snap.end)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		block := int64(binary.BigEndian.Uint64(r[0:]))
+		length := int64(binary.BigEndian.Uint32(r[8:]))
+		snap.blocks[block] = snapshotBlock{snap.end + snapshotRecordSize, length}
+		snap.end += snapshotRecordSize + length
+	}
+	return snap, nil
+}
+
+/*
+Preserves the given range of the backing file for its snapshots, before it
+is modified. No snapshot is taken until the returned function is called,
+once the range has been modified, so snapshots never miss the old blocks.
+*/
+func (fs *trfs) beginModify(name string, off, length int64) (func(), error) {
+	fs.snapMu.RLock()
+	if err := fs.preserve(name, off, length); err != nil {
+		fs.snapMu.RUnlock()
+		return nil, err
+	}
+	return fs.snapMu.RUnlock, nil
+}
+
+/*
+Copies the current version of all blocks in the given range of the backing
+file into the snapshots of the file that do not have their own copy yet,
+fs.snapMu must be held
+*/
+func (fs *trfs) preserve(name string, off, length int64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	snaps, err := fs.loadSnapshots(name)
+	if err != nil || len(snaps) == 0 || length <= 0 {
+		return err
+	}
+	live, err := fs.openDataFile(name, os.O_RDONLY)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer live.Close()
+
+	bs := fs.encodedBlockSize()
+	first := off / bs
+	last := int64(math.MaxInt64)
+	if length < math.MaxInt64-off {
+		last = (off + length - 1) / bs
+	}
+	for _, snap := range snaps {
+		for block := first; block <= last && block*bs < snap.rawSize; block++ {
+			if _, ok := snap.blocks[block]; ok {
+				continue
+			}
+			data := make([]byte, min(bs, snap.rawSize-block*bs))
+			n, err := live.ReadAt(data, block*bs)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			// A short block has been truncated before, which is preserved already
+			if err := fs.appendSnapshotBlock(snap, block, data[:n]); err != nil {
+				return errors.Wrap(err, "Error preserving block")
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *trfs) appendSnapshotBlock(snap *snapshot, block int64, data []byte) error {
+	f, err := fs.Fs.OpenFile(snap.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, snapshotRecordSize+len(data))
+	binary.BigEndian.PutUint64(rec[0:], uint64(block))
+	binary.BigEndian.PutUint32(rec[8:], uint32(len(data)))
+	copy(rec[snapshotRecordSize:], data)
+	_, err = f.WriteAt(rec, snap.end)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	snap.blocks[block] = snapshotBlock{snap.end + snapshotRecordSize, int64(len(data))}
+	snap.end += int64(len(rec))
+	return nil
+}
+
+// Renames the snapshots of oldname to belong to newname
+func (fs *trfs) renameSnapshots(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	snaps, err := fs.loadSnapshots(oldname)
+	if err != nil {
+		return err
+	}
+	// Snapshots of an overwritten target are kept under the new name
+	existing, err := fs.loadSnapshots(newname)
+	if err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		path := fs.snapshotName(newname, snap.id)
+		if err := fs.Fs.Rename(snap.path, path); err != nil {
+			return err
+		}
+		snap.path = path
+	}
+	delete(fs.snapshots, filepath.Clean(oldname))
+	fs.snapshots[filepath.Clean(newname)] = append(existing, snaps...)
+	return nil
+}
+
+// Removes the snapshots of the backing file at path
+func (fs *trfs) removeSnapshots(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	snaps, err := fs.loadSnapshots(path)
+	if err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		if err := fs.removeSidecar(snap.path); err != nil {
+			return err
+		}
+	}
+	delete(fs.snapshots, filepath.Clean(path))
+	return nil
+}
+
+func (fs *trfs) Snapshot(name string) (string, error) {
+	if err := fs.checkWritable("snapshot", name); err != nil {
+		return "", err
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return "", err
+	}
+	// The size has to match the blocks the snapshot starts out sharing
+	fs.snapMu.Lock()
+	defer fs.snapMu.Unlock()
+	info, err := fs.Fs.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", errNoSnapshotOfDir
+	}
+	if fs.header != nil {
+		// Blocks are addressed relative to the end of the header
+		f, err := fs.openDataFile(path, os.O_RDONLY)
+		if err != nil {
+			return "", err
+		}
+		info, err = f.Stat()
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	snaps, err := fs.loadSnapshots(path)
+	if err != nil {
+		return "", err
+	}
+	created, sidecar, f, err := fs.createSnapshot(path, snaps, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	id := strconv.FormatInt(created.UnixNano(), 10)
+	var h [snapshotHeaderSize]byte
+	binary.BigEndian.PutUint32(h[0:], snapshotMagic)
+	binary.BigEndian.PutUint64(h[4:], uint64(created.UnixNano()))
+	binary.BigEndian.PutUint64(h[12:], uint64(info.Size()))
+	_, err = f.Write(h[:])
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.Fs.Remove(sidecar)
+		return "", err
+	}
+	fs.snapshots[filepath.Clean(path)] = append(snaps, &snapshot{
+		id:      id,
+		path:    sidecar,
+		created: created,
+		rawSize: info.Size(),
+		blocks:  make(map[int64]snapshotBlock),
+		end:     snapshotHeaderSize,
+	})
+	return id, nil
+}
+
+/*
+Creates the sidecar of a new snapshot of the backing file at path, which is
+named by its creation time. Snapshots taken within the same clock tick get
+later times, so their IDs are unique and keep their order.
+*/
+func (fs *trfs) createSnapshot(path string, snaps []*snapshot, perm os.FileMode) (time.Time, string, afero.File, error) {
+	nanos := time.Now().UnixNano()
+	if len(snaps) > 0 {
+		if last := snaps[len(snaps)-1].created.UnixNano(); nanos <= last {
+			nanos = last + 1
+		}
+	}
+	for {
+		sidecar := fs.snapshotName(path, strconv.FormatInt(nanos, 10))
+		f, err := fs.Fs.OpenFile(sidecar, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+		if os.IsExist(err) {
+			// Taken by another process
+			nanos++
+			continue
+		}
+		return time.Unix(0, nanos), sidecar, f, err
+	}
+}
+
+func (fs *trfs) Snapshots(name string) ([]SnapshotInfo, error) {
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	snaps, err := fs.loadSnapshots(path)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SnapshotInfo, len(snaps))
+	for i, snap := range snaps {
+		size := snap.rawSize
+		if fs.transforms(name) {
+			size = transformfile.PlaintextSize(size, fs.blockSize, fs.overhead)
+		}
+		infos[i] = SnapshotInfo{
+			ID:      snap.id,
+			Created: snap.created,
+			Size:    size,
+		}
+	}
+	return infos, nil
+}
+
+func (fs *trfs) findSnapshot(name, id string) (*snapshot, int, error) {
+	snaps, err := fs.loadSnapshots(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, snap := range snaps {
+		if snap.id == id {
+			return snap, i, nil
+		}
+	}
+	return nil, 0, ErrSnapshotNotFound
+}
+
+func (fs *trfs) RemoveSnapshot(name, id string) error {
+	if err := fs.checkWritable("removesnapshot", name); err != nil {
+		return err
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	snap, i, err := fs.findSnapshot(path, id)
+	if err != nil {
+		return err
+	}
+	if err := fs.Fs.Remove(snap.path); err != nil {
+		return err
+	}
+	snaps := fs.snapshots[filepath.Clean(path)]
+	fs.snapshots[filepath.Clean(path)] = append(snaps[:i:i], snaps[i+1:]...)
+	return nil
+}
+
+func (fs *trfs) OpenSnapshot(name, id string) (transformfile.File, error) {
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	snap, _, err := fs.findSnapshot(path, id)
+	if err != nil {
+		return nil, err
+	}
+	side, err := fs.Fs.Open(snap.path)
+	if err != nil {
+		return nil, err
+	}
+	live, err := fs.openDataFile(path, os.O_RDONLY)
+	if err != nil && !os.IsNotExist(err) {
+		side.Close()
+		return nil, err
+	}
+	backing := &snapshotFile{
+		fs:        fs,
+		snap:      snap,
+		name:      name,
+		rawSize:   snap.rawSize,
+		blockSize: fs.encodedBlockSize(),
+		side:      side,
+		live:      live,
+	}
+	if !fs.transforms(name) {
+		return backing, nil
+	}
+	return transformfile.NewFromTransformer(
+		fs.blockSize,
+		fs.overhead,
+		backing,
+		true,
+		fs.createReadTransformer(),
+		fs.createWriteTransformer(),
+	), nil
+}
+
+// Backing file of a snapshot, combining preserved and unchanged live blocks
+type snapshotFile struct {
+	fs        *trfs
+	snap      *snapshot
+	name      string
+	rawSize   int64
+	blockSize int64
+	side      afero.File
+	live      afero.File
+	pos       int64
+	closed    bool
+}
+
+type snapshotFileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (i *snapshotFileInfo) Name() string {
+	return i.name
+}
+
+func (i *snapshotFileInfo) Size() int64 {
+	return i.size
+}
+
+/*
+Reads at most up to the end of the block containing off. Blocks are copied
+into the snapshot before the live file is modified, so the block map has
+to be looked up and a live block read while holding fs.mu.
+*/
+func (f *snapshotFile) readBlockAt(p []byte, off int64) (int, error) {
+	if off >= f.rawSize {
+		return 0, io.EOF
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	block := off / f.blockSize
+	blockOffset := off % f.blockSize
+	if b, ok := f.snap.blocks[block]; ok {
+		if blockOffset >= b.length {
+			return 0, io.EOF
+		}
+		n := min(int64(len(p)), b.length-blockOffset)
+		return f.side.ReadAt(p[:n], b.offset+blockOffset)
+	}
+	if f.live == nil {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), min(f.blockSize-blockOffset, f.rawSize-off))
+	return f.live.ReadAt(p[:n], off)
+}
+
+func (f *snapshotFile) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) && err == nil {
+		var m int
+		m, err = f.readBlockAt(p[n:], off+int64(n))
+		n += m
+		if err == io.EOF && m > 0 && off+int64(n) < f.rawSize {
+			err = nil
+		}
+		if err == nil && m == 0 {
+			err = io.EOF
+		}
+	}
+	return n, err
+}
+
+func (f *snapshotFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *snapshotFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.rawSize
+	default:
+		return f.pos, fmt.Errorf("unsupported seek mode")
+	}
+	if offset < 0 {
+		return f.pos, transformfile.ErrInvalidSeek
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *snapshotFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	err := f.side.Close()
+	if f.live != nil {
+		if liveErr := f.live.Close(); err == nil {
+			err = liveErr
+		}
+	}
+	return err
+}
+
+func (f *snapshotFile) Name() string {
+	return f.name
+}
+
+func (f *snapshotFile) Stat() (os.FileInfo, error) {
+	info, err := f.side.Stat()
+	if info != nil {
+		info = &snapshotFileInfo{info, filepath.Base(f.name), f.rawSize}
+	}
+	return info, err
+}
+
+func (f *snapshotFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errSnapshotReadOnly
+}
+
+func (f *snapshotFile) Readdirnames(n int) ([]string, error) {
+	return nil, errSnapshotReadOnly
+}
+
+func (f *snapshotFile) Sync() error {
+	return nil
+}
+
+func (f *snapshotFile) Truncate(size int64) error {
+	return errSnapshotReadOnly
+}
+
+func (f *snapshotFile) Write(p []byte) (int, error) {
+	return 0, errSnapshotReadOnly
+}
+
+func (f *snapshotFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errSnapshotReadOnly
+}
+
+func (f *snapshotFile) WriteString(s string) (int, error) {
+	return 0, errSnapshotReadOnly
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
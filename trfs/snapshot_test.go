@@ -0,0 +1,253 @@
+package trfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func Key(s string) *[32]byte {
+	var key [32]byte
+	copy(key[:], s)
+	return &key
+}
+
+func readSnapshot(t *testing.T, fs trfs.Snapshotter, name, id string) string {
+	f, err := fs.OpenSnapshot(name, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(d)
+}
+
+func TestSnapshot(t *testing.T) {
+	fs := naclfs.New(4, Key("snapshot"), afero.NewMemMapFs())
+	snapper := fs.(trfs.Snapshotter)
+	if err := afero.WriteFile(fs, "file", []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := snapper.Snapshot("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile("file", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("J"), 0)
+	f.WriteAt([]byte("w"), 7)
+	f.Close()
+
+	if d, _ := afero.ReadFile(fs, "file"); string(d) != "Jello, world!" {
+		t.Errorf("Unexpected live contents %q", d)
+	}
+	if d := readSnapshot(t, snapper, "file", id); d != "Hello, World!" {
+		t.Errorf("Unexpected snapshot contents %q", d)
+	}
+
+	// Replacing the file must not affect the snapshot
+	if err := afero.WriteFile(fs, "file", []byte("Bye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if d := readSnapshot(t, snapper, "file", id); d != "Hello, World!" {
+		t.Errorf("Unexpected snapshot contents after rewrite %q", d)
+	}
+
+	infos, err := snapper.Snapshots("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].ID != id || infos[0].Size != 13 {
+		t.Errorf("Unexpected snapshot list %v", infos)
+	}
+	names, _ := afero.ReadDir(fs, "/")
+	if len(names) != 1 {
+		t.Errorf("Snapshot sidecars should be hidden, got %d entries", len(names))
+	}
+
+	if err := snapper.RemoveSnapshot("file", id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snapper.OpenSnapshot("file", id); err != trfs.ErrSnapshotNotFound {
+		t.Errorf("Expected removed snapshot to be gone, got %v", err)
+	}
+}
+
+func TestSnapshotOpenDuringWrite(t *testing.T) {
+	fs := naclfs.New(4, Key("snapshot"), afero.NewMemMapFs())
+	snapper := fs.(trfs.Snapshotter)
+	afero.WriteFile(fs, "file", []byte("Hello, World!"), 0644)
+	id, err := snapper.Snapshot("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := snapper.OpenSnapshot("file", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	// Blocks modified after opening are read from the snapshot
+	f, err := fs.OpenFile("file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("J"), 0)
+	f.Close()
+
+	d := make([]byte, 5)
+	if _, err := snap.ReadAt(d, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(d) != "Hello" {
+		t.Errorf("Unexpected snapshot contents %q", d)
+	}
+}
+
+func TestSnapshotRename(t *testing.T) {
+	fs := naclfs.New(4, Key("snapshot"), afero.NewMemMapFs())
+	snapper := fs.(trfs.Snapshotter)
+	afero.WriteFile(fs, "a", []byte("original"), 0644)
+	id, err := snapper.Snapshot("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	fs.Remove("b")
+	if d := readSnapshot(t, snapper, "b", id); d != "original" {
+		t.Errorf("Unexpected snapshot contents %q", d)
+	}
+}
+
+func TestSnapshotIDsUnique(t *testing.T) {
+	fs := naclfs.New(4, Key("snapshot"), afero.NewMemMapFs())
+	snapper := fs.(trfs.Snapshotter)
+	afero.WriteFile(fs, "file", []byte("data"), 0644)
+	ids := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		id, err := snapper.Snapshot("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids[id] {
+			t.Fatalf("Snapshot ID %s taken twice", id)
+		}
+		ids[id] = true
+	}
+	infos, err := snapper.Snapshots("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(ids) {
+		t.Errorf("Expected %d snapshots, got %d", len(ids), len(infos))
+	}
+	for i := 1; i < len(infos); i++ {
+		if !infos[i-1].Created.Before(infos[i].Created) {
+			t.Errorf("Snapshots are not ordered: %v", infos)
+		}
+	}
+}
+
+// Holds writes to backing files until released, once armed
+type pausingFs struct {
+	afero.Fs
+	armed   chan struct{}
+	entered chan struct{}
+	release chan struct{}
+}
+
+type pausingFile struct {
+	afero.File
+	fs *pausingFs
+}
+
+func (fs *pausingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &pausingFile{f, fs}, nil
+}
+
+func (f *pausingFile) pause() {
+	select {
+	case <-f.fs.armed:
+		f.fs.entered <- struct{}{}
+		<-f.fs.release
+	default:
+	}
+}
+
+func (f *pausingFile) Write(p []byte) (int, error) {
+	f.pause()
+	return f.File.Write(p)
+}
+
+func (f *pausingFile) WriteAt(p []byte, off int64) (int, error) {
+	f.pause()
+	return f.File.WriteAt(p, off)
+}
+
+func TestSnapshotConcurrentWrite(t *testing.T) {
+	backing := &pausingFs{
+		Fs:      afero.NewMemMapFs(),
+		armed:   make(chan struct{}, 1),
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	fs := naclfs.New(4, Key("snapshot"), backing)
+	snapper := fs.(trfs.Snapshotter)
+	afero.WriteFile(fs, "file", []byte("0000"), 0644)
+	f, err := fs.OpenFile("file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// A write is under way, past preserving blocks for snapshots
+	backing.armed <- struct{}{}
+	written := make(chan error)
+	go func() {
+		_, err := f.WriteAt([]byte("1111"), 0)
+		written <- err
+	}()
+	<-backing.entered
+	taken := make(chan string)
+	go func() {
+		id, err := snapper.Snapshot("file")
+		if err != nil {
+			t.Error(err)
+		}
+		taken <- id
+	}()
+	var id, before string
+	select {
+	case id = <-taken:
+		before = readSnapshot(t, snapper, "file", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(backing.release)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		id = <-taken
+	}
+	after := readSnapshot(t, snapper, "file", id)
+	if before != "" && before != after {
+		t.Errorf("Snapshot changed from %q to %q with a write in flight", before, after)
+	}
+}
@@ -0,0 +1,82 @@
+package trfs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+)
+
+func TestStatPlaintextSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backing := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	fs := naclfs.New(16, Key("stat"), backing)
+
+	data := bytes.Repeat([]byte("x"), 100)
+	fs.MkdirAll("sub", 0755)
+	if err := afero.WriteFile(fs, "sub/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fs.Stat("sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("Stat: unexpected size %d, expected %d", info.Size(), len(data))
+	}
+	info, _, err = fs.(afero.Lstater).LstatIfPossible("sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("Lstat: unexpected size %d, expected %d", info.Size(), len(data))
+	}
+
+	dirInfo, _ := fs.Stat("sub")
+	rawDirInfo, _ := backing.Stat("sub")
+	if dirInfo.Size() != rawDirInfo.Size() {
+		t.Errorf("Directory size changed from %d to %d", rawDirInfo.Size(), dirInfo.Size())
+	}
+
+	infos, err := afero.ReadDir(fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Size() != rawDirInfo.Size() {
+		t.Errorf("Readdir: unexpected directory entries %v", infos)
+	}
+	infos, err = afero.ReadDir(fs, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Size() != int64(len(data)) {
+		t.Errorf("Readdir: unexpected file entries %v", infos)
+	}
+
+	read, err := afero.ReadFile(fs, "sub/file")
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("ReadFile returned unexpected data: %v", err)
+	}
+
+	err = afero.Walk(fs, "sub", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == filepath.Join("sub", "file") && info.Size() != int64(len(data)) {
+			t.Errorf("Walk: unexpected size %d, expected %d", info.Size(), len(data))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
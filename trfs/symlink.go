@@ -0,0 +1,143 @@
+package trfs
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var _ afero.Symlinker = (*trfs)(nil)
+
+var errInvalidLinkTarget = fmt.Errorf("invalid link target")
+
+/*
+Encrypts a link target with a random IV of its own, which is stored in
+front of the encrypted target. Identical targets do not encrypt to the
+same backing target, and targets do not depend on the directory of the
+link, so links can be moved without re-encrypting them.
+*/
+func (fs *trfs) encryptTarget(target string) (string, error) {
+	iv := make([]byte, dirIVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	encrypted, err := fs.names.EncryptName(target, iv)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(iv) + "." + encrypted, nil
+}
+
+func (fs *trfs) decryptTarget(target string) (string, error) {
+	parts := strings.SplitN(target, ".", 2)
+	if len(parts) != 2 {
+		return "", errInvalidLinkTarget
+	}
+	iv, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(iv) != dirIVSize {
+		return "", errInvalidLinkTarget
+	}
+	return fs.names.DecryptName(parts[1], iv)
+}
+
+/*
+SymlinkIfPossible creates newname as a symbolic link to oldname, if the
+backing filesystem supports symbolic links. With name encryption enabled
+the target is stored encrypted, so the backing filesystem can no longer
+resolve the link; it can still be read with ReadlinkIfPossible.
+*/
+func (fs *trfs) SymlinkIfPossible(oldname, newname string) error {
+	if err := fs.checkLinkWritable("symlink", oldname, newname); err != nil {
+		return err
+	}
+	linker, ok := fs.Fs.(afero.Linker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+	}
+	path, err := fs.backingPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	target := oldname
+	if fs.names != nil {
+		if target, err = fs.encryptTarget(oldname); err != nil {
+			return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+		}
+	}
+	if err := linker.SymlinkIfPossible(target, path); err != nil {
+		return linkError(err, oldname, newname)
+	}
+	return fs.notify(fs.storeLongName(newname, path), Event{Op: EventCreate, Name: newname})
+}
+
+/*
+ReadlinkIfPossible returns the target of the symbolic link, if the backing
+filesystem supports symbolic links
+*/
+func (fs *trfs) ReadlinkIfPossible(name string) (string, error) {
+	reader, ok := fs.Fs.(afero.LinkReader)
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	target, err := reader.ReadlinkIfPossible(path)
+	if err != nil || fs.names == nil {
+		return target, pathError(err, name)
+	}
+	plain, err := fs.decryptTarget(fs.storedTarget(target))
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return plain, nil
+}
+
+/*
+Returns an encrypted link target as it was passed to the backing.
+afero.BasePathFs stores targets below its base path, but reads them back
+including it.
+*/
+func (fs *trfs) storedTarget(target string) string {
+	base, ok := fs.Fs.(*afero.BasePathFs)
+	if !ok {
+		return target
+	}
+	root, err := base.RealPath(string(filepath.Separator))
+	if err != nil {
+		return target
+	}
+	if rel, err := filepath.Rel(root, target); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return target
+}
+
+func (fs *trfs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	lstater, ok := fs.Fs.(afero.Lstater)
+	if !ok {
+		info, err := fs.Stat(name)
+		return info, false, err
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return nil, false, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	info, lstatCalled, err := lstater.LstatIfPossible(path)
+	return fs.fileInfo(info, name), lstatCalled, pathError(err, name)
+}
+
+// Stats a backing path without following symbolic links, if possible
+func (fs *trfs) lstat(path string) (os.FileInfo, error) {
+	if lstater, ok := fs.Fs.(afero.Lstater); ok {
+		info, _, err := lstater.LstatIfPossible(path)
+		return info, err
+	}
+	return fs.Fs.Stat(path)
+}
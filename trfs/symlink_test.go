@@ -0,0 +1,123 @@
+package trfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+)
+
+func TestSymlinkEncryptedTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backing := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	fs := naclfs.New(16, Key("links"), backing, naclfs.WithNameEncryption(Key("links")))
+	links := fs.(afero.Symlinker)
+
+	fs.MkdirAll("/dir", 0755)
+	if err := links.SymlinkIfPossible("../secret/target.txt", "/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	target, err := links.ReadlinkIfPossible("/dir/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../secret/target.txt" {
+		t.Errorf("Unexpected link target %q", target)
+	}
+
+	for _, n := range backingNames(t, backing) {
+		if strings.Contains(n, "link") {
+			t.Errorf("Backing path %q leaks plaintext name", n)
+		}
+		info, _, err := backing.(afero.Lstater).LstatIfPossible(n)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		raw, err := backing.(afero.LinkReader).ReadlinkIfPossible(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(raw, "secret") {
+			t.Errorf("Backing link target %q leaks plaintext target", raw)
+		}
+	}
+
+	// Identical targets are stored differently
+	if err := links.SymlinkIfPossible("../secret/target.txt", "/dir/link2"); err != nil {
+		t.Fatal(err)
+	}
+	var raws []string
+	for _, n := range backingNames(t, backing) {
+		if raw, err := backing.(afero.LinkReader).ReadlinkIfPossible(n); err == nil {
+			raws = append(raws, raw)
+		}
+	}
+	if len(raws) != 2 || raws[0] == raws[1] {
+		t.Errorf("Identical targets should not be stored identically: %q", raws)
+	}
+	fs.Remove("/dir/link2")
+
+	// Targets do not depend on the directory of the link
+	fs.MkdirAll("/other", 0755)
+	if err := fs.Rename("/dir/link", "/other/link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := links.ReadlinkIfPossible("/other/link"); err != nil || target != "../secret/target.txt" {
+		t.Errorf("Unexpected link target after rename %q, %v", target, err)
+	}
+
+	info, _, err := links.LstatIfPossible("/other/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "link" || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Unexpected lstat result %s, %v", info.Name(), info.Mode())
+	}
+	if err := fs.Remove("/other/link"); err != nil {
+		t.Errorf("Could not remove link: %v", err)
+	}
+	if _, _, err := links.LstatIfPossible("/other/link"); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+}
+
+func TestSymlinkPlaintext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backing := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	fs := naclfs.New(16, Key("links"), backing)
+	links := fs.(afero.Symlinker)
+
+	if err := afero.WriteFile(fs, "file", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := links.SymlinkIfPossible("file", "link"); err != nil {
+		t.Fatal(err)
+	}
+	// Without name encryption the backing filesystem resolves the link
+	if d, err := afero.ReadFile(fs, "link"); err != nil || string(d) != "content" {
+		t.Errorf("Unexpected contents through link %q, %v", d, err)
+	}
+}
+
+func TestSymlinkNotSupported(t *testing.T) {
+	links := naclfs.New(16, Key("links"), afero.NewMemMapFs()).(afero.Symlinker)
+	err := links.SymlinkIfPossible("target", "link")
+	if e, ok := err.(*os.LinkError); !ok || e.Err != afero.ErrNoSymlink {
+		t.Errorf("Expected ErrNoSymlink, got %v", err)
+	}
+	_, err = links.ReadlinkIfPossible("link")
+	if e, ok := err.(*os.PathError); !ok || e.Err != afero.ErrNoReadlink {
+		t.Errorf("Expected ErrNoReadlink, got %v", err)
+	}
+}
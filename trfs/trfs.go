@@ -1,11 +1,17 @@
 package trfs
 
 import (
-	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/spf13/afero"
 	"github.com/tobiash/go-transformfile"
+	"github.com/tobiash/go-transformfile/trfs/parity"
 	"golang.org/x/text/transform"
 )
 
@@ -16,73 +22,560 @@ type trfs struct {
 	overhead               int
 	createReadTransformer  func() transform.Transformer
 	createWriteTransformer func() transform.Transformer
+	parity                 *parity.Encoder
+	names                  NameTransformer
+	// Header of transformed files and whether their blocks are framed, if
+	// codecs are chained
+	header        []byte
+	framed        bool
+	maxNameLength int
+	rules         []Rule
+
+	mu        sync.Mutex
+	snapshots map[string][]*snapshot
+	// Held exclusively while taking a snapshot, shared while modifying preserved blocks
+	snapMu sync.RWMutex
+
+	ivMu   sync.Mutex
+	dirIVs map[string][]byte
+
+	// Open transformed files and lock tables by backing path
+	filesMu sync.Mutex
+	files   map[string]*openFile
+	locks   map[string]*lockTable
+
+	// Callbacks for changes made through the filesystem
+	subsMu sync.Mutex
+	subs   []*subscriber
+
+	// Usage of directories, nil unless tracked
+	usage *usageTracker
+	// Limits by plaintext directory
+	quotas map[string]Usage
+
+	// Progress of converting a plaintext tree, nil unless enabled
+	migration *checkpoint
+	// Nothing is written to the backing filesystem
+	readOnly bool
+}
+
+/*
+Option configures optional features of a transforming filesystem
+*/
+type Option func(*trfs)
+
+// Prefix of files used internally, which are hidden from directory listings
+const internalPrefix = ".trfs."
+
+func isInternalName(name string) bool {
+	return strings.HasPrefix(name, internalPrefix)
+}
+
+// Handle returned for files opened through trfs
+type file struct {
+	transformfile.File
+	fs   *trfs
+	name string
+	// Path of the backing file
+	path string
+	// Flags the file was opened with
+	flag int
+	// Advisory locks, set by the first lock operation
+	locks  *lockTable
+	closed bool
 }
 
 /*
 NewTransformFileFs creates a new filesystem that passes files through the given transformations.
-File stats accounts for transform overhead, but filenames are not changed.
+File stats accounts for transform overhead. Filenames are not changed, unless
+a name transformer is configured with WithNameTransformer.
 */
 func NewTransformFileFs(
 	blockSize int64,
 	overhead int,
 	name string,
 	backing afero.Fs,
-	readTr, writeTr func() transform.Transformer) afero.Fs {
-	return &trfs{backing, name, blockSize, overhead, readTr, writeTr}
+	readTr, writeTr func() transform.Transformer,
+	opts ...Option) afero.Fs {
+	fs := &trfs{
+		Fs:                     backing,
+		name:                   name,
+		blockSize:              blockSize,
+		overhead:               overhead,
+		createReadTransformer:  readTr,
+		createWriteTransformer: writeTr,
+		maxNameLength:          DefaultMaxNameLength,
+		snapshots:              make(map[string][]*snapshot),
+		dirIVs:                 make(map[string][]byte),
+		files:                  make(map[string]*openFile),
+		locks:                  make(map[string]*lockTable),
+	}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	return fs
+}
+
+// Size of a block in the backing file
+func (fs *trfs) encodedBlockSize() int64 {
+	return fs.blockSize + int64(fs.overhead)
 }
 
-func (fs *trfs) newFile(f afero.File, readOnly bool) afero.File {
-	readTr := fs.createReadTransformer()
-	writeTr := fs.createWriteTransformer()
-	return transformfile.NewFromTransformer(
+/*
+Wraps a backing file in a handle. Directories and files excluded by the
+rules are not transformed, though snapshots and parity of excluded files
+are kept in sync.
+*/
+func (fs *trfs) newFile(f afero.File, name, path string, flag int) (afero.File, error) {
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return &file{File: f, fs: fs, name: name, path: path, flag: flag}, nil
+	}
+	if !fs.transforms(name) {
+		backing := &backingFile{File: f, fs: fs, name: path, append: flag&os.O_APPEND != 0}
+		return &file{File: backing, fs: fs, name: name, path: path, flag: flag}, nil
+	}
+	data, err := fs.openData(f, flag&(os.O_WRONLY|os.O_RDWR) != 0)
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	backing := &backingFile{File: data, fs: fs, name: path}
+	inner := transformfile.NewFromTransformer(
 		fs.blockSize,
 		fs.overhead,
-		f,
-		readOnly,
-		readTr,
-		writeTr,
+		backing,
+		!writable,
+		fs.createReadTransformer(),
+		fs.createWriteTransformer(),
 	)
+	shared := fs.share(path, inner, backing, writable)
+	shared.append = flag&os.O_APPEND != 0
+	return &file{File: shared, fs: fs, name: name, path: path, flag: flag}, nil
 }
 
 func (fs *trfs) Create(name string) (afero.File, error) {
-	f, err := fs.Fs.Create(name)
+	if err := fs.checkWritable("open", name); err != nil {
+		return nil, err
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	done, err := fs.beginModify(path, 0, math.MaxInt64)
 	if err != nil {
 		return nil, err
 	}
-	return fs.newFile(f, false), nil
+	release, err := fs.reserveCreate(name, path, os.O_CREATE)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	defer release()
+	op := fs.openOp(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	f, err := fs.Fs.Create(path)
+	done()
+	if err != nil {
+		return nil, pathError(err, name)
+	}
+	if err := fs.storeLongNameIfCreated(name, path, os.O_CREATE); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := fs.truncateParity(path, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	handle, err := fs.newFile(f, name, path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	fs.updateUsage(path, name)
+	return fs.notifyOpen(op, name, handle, err)
 }
 
 func (fs *trfs) Open(name string) (afero.File, error) {
-	f, err := fs.Fs.Open(name)
+	path, err := fs.backingPath(name)
 	if err != nil {
-		return nil, err
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	f, err := fs.Fs.Open(path)
+	if err != nil {
+		return nil, pathError(err, name)
 	}
-	return fs.newFile(f, false), nil
+	return fs.newFile(f, name, path, os.O_RDONLY)
 }
 
 func (fs *trfs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
-	// WR_ONLY can not be passed down
-	if flag&os.O_WRONLY != 0 {
-		flag &= ^os.O_WRONLY
-		flag |= os.O_RDWR
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := fs.checkWritable("open", name); err != nil {
+			return nil, err
+		}
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
 	}
-	f, err := fs.Fs.OpenFile(name, flag&^os.O_APPEND, perm)
+	// Not all backing filesystems honour O_EXCL
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		if _, err := fs.lstat(path); err == nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+	}
+	done := func() {}
+	if flag&os.O_TRUNC != 0 {
+		if done, err = fs.beginModify(path, 0, math.MaxInt64); err != nil {
+			return nil, err
+		}
+	}
+	release, err := fs.reserveCreate(name, path, flag)
 	if err != nil {
+		done()
 		return nil, err
 	}
-	readOnly := flag&os.O_RDONLY != 0
-	n := fs.newFile(f, readOnly)
-	if flag&os.O_APPEND > 0 && n != nil {
-		n.Seek(0, io.SeekEnd)
+	defer release()
+	op := fs.openOp(path, flag)
+	bflag := flag
+	if fs.transforms(name) {
+		bflag = backingFlag(flag)
+	}
+	f, err := fs.Fs.OpenFile(path, bflag, perm)
+	done()
+	if err != nil {
+		return nil, pathError(err, name)
+	}
+	if err := fs.storeLongNameIfCreated(name, path, flag); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 {
+		if err := fs.truncateParity(path, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	handle, err := fs.newFile(f, name, path, flag)
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		fs.updateUsage(path, name)
+	}
+	return fs.notifyOpen(op, name, handle, err)
+}
+
+func (fs *trfs) Mkdir(name string, perm os.FileMode) error {
+	if err := fs.checkWritable("mkdir", name); err != nil {
+		return err
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return pathError(fs.mkdir(name, path, perm), name)
+}
+
+func (fs *trfs) MkdirAll(name string, perm os.FileMode) error {
+	if err := fs.checkWritable("mkdir", name); err != nil {
+		return err
+	}
+	if fs.names == nil {
+		missing := fs.missingDirs(name)
+		if err := fs.Fs.MkdirAll(name, perm); err != nil {
+			return err
+		}
+		for _, dir := range missing {
+			fs.notify(nil, Event{Op: EventCreate, Name: dir})
+		}
+		return nil
+	}
+	root, components := splitPath(filepath.Clean(name))
+	dir := root
+	for i, c := range components {
+		enc, err := fs.backingName(dir, c)
+		if err != nil {
+			return &os.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+		dir = filepath.Join(dir, enc)
+		info, err := fs.Fs.Stat(dir)
+		if os.IsNotExist(err) {
+			err = fs.mkdir(filepath.Join(append([]string{root}, components[:i+1]...)...), dir, perm)
+		} else if err == nil && !info.IsDir() {
+			err = &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		if err != nil {
+			return pathError(err, name)
+		}
+	}
+	return nil
+}
+
+func (fs *trfs) Remove(name string) error {
+	if err := fs.checkWritable("remove", name); err != nil {
+		return err
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	info, err := fs.lstat(path)
+	if err != nil {
+		return pathError(err, name)
+	}
+	if info.IsDir() {
+		return pathError(fs.notify(fs.removeDir(path), Event{Op: EventRemove, Name: name}), name)
+	}
+	// Snapshots outlive the file, so they need a copy of every block
+	done := func() {}
+	if info.Mode().IsRegular() {
+		if done, err = fs.beginModify(path, 0, math.MaxInt64); err != nil {
+			return err
+		}
+	}
+	err = fs.Fs.Remove(path)
+	done()
+	if err != nil {
+		return pathError(err, name)
+	}
+	fs.emit(Event{Op: EventRemove, Name: name})
+	fs.dropUsage(path)
+	fs.forgetOpenFiles(path)
+	if err := fs.removeLongName(path); err != nil {
+		return err
+	}
+	if err := fs.removeSidecar(fs.attrName(path)); err != nil {
+		return err
+	}
+	return fs.removeSidecar(fs.parityName(path))
+}
+
+// Removes an empty directory, including the internal files in it
+func (fs *trfs) removeDir(path string) error {
+	d, err := fs.Fs.Open(path)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	var internal []string
+	for _, n := range names {
+		if !isInternalName(n) {
+			// Let the backing filesystem report the directory as not empty
+			return fs.Fs.Remove(path)
+		}
+		internal = append(internal, n)
+	}
+	for _, n := range internal {
+		if err := fs.Fs.Remove(filepath.Join(path, n)); err != nil {
+			return err
+		}
+	}
+	fs.forgetDirIVs(path)
+	if err := fs.Fs.Remove(path); err != nil {
+		return err
+	}
+	if err := fs.removeSidecar(fs.attrName(path)); err != nil {
+		return err
+	}
+	return fs.removeLongName(path)
+}
+
+func (fs *trfs) RemoveAll(name string) error {
+	if err := fs.checkWritable("removeall", name); err != nil {
+		return err
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return &os.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	info, err := fs.lstat(path)
+	if err == nil && !info.IsDir() {
+		return fs.Remove(name)
+	}
+	fs.forgetDirIVs(path)
+	if err := fs.Fs.RemoveAll(path); err != nil {
+		return pathError(err, name)
+	}
+	if info != nil {
+		fs.emit(Event{Op: EventRemove, Name: name})
+	}
+	fs.dropUsage(path)
+	fs.forgetOpenFiles(path)
+	if err := fs.removeSidecar(fs.attrName(path)); err != nil {
+		return err
+	}
+	return fs.removeLongName(path)
+}
+
+func (fs *trfs) Rename(oldname, newname string) error {
+	if err := fs.checkLinkWritable("rename", oldname, newname); err != nil {
+		return err
+	}
+	oldpath, err := fs.backingPath(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	newpath, err := fs.backingPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if err := fs.checkRenameRules(oldname, newname, oldpath); err != nil {
+		return err
+	}
+	done, err := fs.beginModify(newpath, 0, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	err = fs.Fs.Rename(oldpath, newpath)
+	done()
+	if err != nil {
+		return linkError(err, oldname, newname)
+	}
+	fs.moveUsage(oldpath, newpath)
+	fs.notify(nil, Event{Op: EventRename, Name: newname, OldName: oldname})
+	fs.forgetDirIVs(oldpath)
+	fs.forgetDirIVs(newpath)
+	fs.forgetOpenFiles(newpath)
+	fs.renameOpenFiles(oldpath, newpath)
+	if err := fs.removeLongName(oldpath); err != nil {
+		return err
+	}
+	if err := fs.storeLongName(newname, newpath); err != nil {
+		return err
+	}
+	if err := fs.renameSidecar(fs.parityName(oldpath), fs.parityName(newpath)); err != nil {
+		return err
+	}
+	if err := fs.renameSidecar(fs.attrName(oldpath), fs.attrName(newpath)); err != nil {
+		return err
+	}
+	return fs.renameSnapshots(oldpath, newpath)
+}
+
+// Removes a sidecar file, which may not exist
+func (fs *trfs) removeSidecar(name string) error {
+	if err := fs.Fs.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	return n, nil
+	return nil
+}
+
+// Renames a sidecar file, which may not exist
+func (fs *trfs) renameSidecar(oldname, newname string) error {
+	if _, err := fs.Fs.Stat(oldname); os.IsNotExist(err) {
+		return fs.removeSidecar(newname)
+	}
+	return fs.Fs.Rename(oldname, newname)
 }
 
 func (fs *trfs) Stat(name string) (os.FileInfo, error) {
-	// TODO Account for overhead in file sizes?
-	return fs.Fs.Stat(name)
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	info, err := fs.Fs.Stat(path)
+	return fs.fileInfo(info, name), pathError(err, name)
+}
+
+func (fs *trfs) Chmod(name string, mode os.FileMode) error {
+	if err := fs.checkWritable("chmod", name); err != nil {
+		return err
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	return pathError(fs.Fs.Chmod(path, mode), name)
+}
+
+func (fs *trfs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := fs.checkWritable("chtimes", name); err != nil {
+		return err
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	return pathError(fs.Fs.Chtimes(path, atime, mtime), name)
+}
+
+/*
+Corrects the size of a backing FileInfo to the plaintext size and
+reports the plaintext name
+*/
+func (fs *trfs) fileInfo(info os.FileInfo, name string) os.FileInfo {
+	if fs.transforms(name) {
+		if fs.header != nil && info != nil && info.Mode().IsRegular() {
+			info = &offsetFileInfo{info, int64(len(fs.header))}
+		}
+		info = transformfile.NewFileInfo(info, fs.blockSize, fs.overhead)
+	}
+	if info != nil && fs.names != nil {
+		info = &namedFileInfo{info, filepath.Base(name)}
+	}
+	return info
 }
 
 func (fs *trfs) Name() string {
 	return fs.name
 }
+
+func (f *file) Name() string {
+	return f.name
+}
+
+func (f *file) entryName(name string) (string, bool) {
+	return f.fs.entryName(f.path, name)
+}
+
+/*
+Translates an entry of the backing directory dir, returning false for
+hidden entries
+*/
+func (fs *trfs) entryName(dir, name string) (string, bool) {
+	if fs.names != nil && isLongName(name) {
+		enc, err := fs.readLongName(filepath.Join(dir, name))
+		if err != nil {
+			return "", false
+		}
+		name = enc
+	} else if isInternalName(name) {
+		return "", false
+	}
+	if fs.names == nil {
+		return name, true
+	}
+	plain, err := fs.decryptName(dir, name)
+	// Entries that can not be decrypted were not created through trfs
+	return plain, err == nil
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	var res []os.FileInfo
+	for {
+		want := count - len(res)
+		infos, err := f.File.Readdir(want)
+		for _, info := range infos {
+			if name, ok := f.entryName(info.Name()); ok {
+				res = append(res, f.fs.fileInfo(info, filepath.Join(f.name, name)))
+			}
+		}
+		// Only a full batch that contained hidden entries needs a refill
+		if err != nil || count <= 0 || len(res) >= count || len(infos) < want {
+			return res, err
+		}
+	}
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	var res []string
+	for {
+		want := n - len(res)
+		names, err := f.File.Readdirnames(want)
+		for _, name := range names {
+			if name, ok := f.entryName(name); ok {
+				res = append(res, name)
+			}
+		}
+		if err != nil || n <= 0 || len(res) >= n || len(names) < want {
+			return res, err
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package trfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+/*
+Usage counts the regular files below a directory. Bytes is their plaintext
+size, StoredBytes their size on the backing filesystem, including the
+overhead of the transformation. Sidecar files are not counted.
+*/
+type Usage struct {
+	Files       int64
+	Bytes       int64
+	StoredBytes int64
+}
+
+func (u Usage) add(o Usage) Usage {
+	return Usage{u.Files + o.Files, u.Bytes + o.Bytes, u.StoredBytes + o.StoredBytes}
+}
+
+func (u Usage) sub(o Usage) Usage {
+	return Usage{u.Files - o.Files, u.Bytes - o.Bytes, u.StoredBytes - o.StoredBytes}
+}
+
+/*
+UsageReporter is implemented by trfs filesystems. Usage returns the usage
+of a directory tree or a single file. SaveUsage persists the usage at the
+root of the backing filesystem, so filesystems created on it later load it
+instead of scanning the tree. Both fail unless usage is tracked.
+*/
+type UsageReporter interface {
+	Usage(name string) (Usage, error)
+	SaveUsage() error
+}
+
+var _ UsageReporter = (*trfs)(nil)
+
+var errUsageNotTracked = fmt.Errorf("usage is not tracked")
+
+/*
+QuotaError is returned by writes that would take the usage of a directory
+with a quota beyond one of its limits
+*/
+type QuotaError struct {
+	// Plaintext name of the directory
+	Dir   string
+	Quota Usage
+	// Usage the write would have led to
+	Usage Usage
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("Quota of %s exceeded", e.Dir)
+}
+
+/*
+UsageName is the name of the file at the root of the backing filesystem
+the usage is persisted in by SaveUsage
+*/
+const UsageName = internalPrefix + "usage"
+
+/*
+WithUsage tracks the usage of each directory. The first use loads the usage
+persisted by SaveUsage, or scans the filesystem if there is none. The first
+change after that removes the persisted usage, so it is not used after a
+crash. Changes made by filesystems that do not track usage are not noticed.
+*/
+func WithUsage() Option {
+	return func(fs *trfs) {
+		if fs.usage == nil {
+			fs.usage = &usageTracker{backing: fs.Fs}
+		}
+	}
+}
+
+/*
+WithQuota limits the usage of the directory tree at dir and enables usage
+tracking. Zero fields of limit are not limited. Writes and creations that
+would go beyond a limit fail with a QuotaError; changes that shrink files
+are always allowed.
+*/
+func WithQuota(dir string, limit Usage) Option {
+	return func(fs *trfs) {
+		WithUsage()(fs)
+		if fs.quotas == nil {
+			fs.quotas = make(map[string]Usage)
+		}
+		fs.quotas[filepath.Clean(dir)] = limit
+	}
+}
+
+type usageTracker struct {
+	mu      sync.Mutex
+	backing afero.Fs
+	scanned bool
+	// The usage at UsageName is up to date
+	persisted bool
+	// Usage of regular files by backing path
+	files map[string]Usage
+	// Totals of the files below backing directories
+	dirs map[string]Usage
+	// Growth reserved by changes in progress, like files and dirs
+	reserved     map[string]Usage
+	reservedDirs map[string]Usage
+}
+
+// Backing path of the persisted usage
+func usagePath() string {
+	return filepath.Join(string(filepath.Separator), UsageName)
+}
+
+func (fs *trfs) Usage(name string) (Usage, error) {
+	if fs.usage == nil {
+		return Usage{}, &os.PathError{Op: "usage", Path: name, Err: errUsageNotTracked}
+	}
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return Usage{}, &os.PathError{Op: "usage", Path: name, Err: err}
+	}
+	t, err := fs.usageTracker()
+	if err != nil {
+		return Usage{}, err
+	}
+	defer t.mu.Unlock()
+	path = filepath.Clean(path)
+	if u, ok := t.files[path]; ok {
+		return u, nil
+	}
+	if _, err := fs.lstat(path); err != nil {
+		return Usage{}, pathError(err, name)
+	}
+	return t.dirs[path], nil
+}
+
+/*
+Returns the locked usage tracker, loading the persisted usage or scanning
+the filesystem if it has not been done yet
+*/
+func (fs *trfs) usageTracker() (*usageTracker, error) {
+	t := fs.usage
+	t.mu.Lock()
+	if t.scanned {
+		return t, nil
+	}
+	t.files, t.dirs = make(map[string]Usage), make(map[string]Usage)
+	t.reserved, t.reservedDirs = make(map[string]Usage), make(map[string]Usage)
+	if files, err := t.load(); err != nil {
+		t.mu.Unlock()
+		return nil, err
+	} else if files != nil {
+		for path, u := range files {
+			t.set(path, u)
+		}
+		t.scanned, t.persisted = true, true
+		return t, nil
+	}
+	err := afero.Walk(fs, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil || !isRegular(info) {
+			return err
+		}
+		path, err := fs.backingPath(name)
+		if err != nil {
+			return err
+		}
+		stored, err := fs.lstat(path)
+		if err != nil {
+			return err
+		}
+		t.set(filepath.Clean(path), Usage{1, info.Size(), stored.Size()})
+		return nil
+	})
+	if err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
+	t.scanned = true
+	return t, nil
+}
+
+// Some backings, like afero.MemMapFs, report implicitly created directories as regular files
+func isRegular(info os.FileInfo) bool {
+	return info.Mode().IsRegular() && !info.IsDir()
+}
+
+// Reads the persisted usage of files, nil if there is none
+func (t *usageTracker) load() (map[string]Usage, error) {
+	data, err := afero.ReadFile(t.backing, usagePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]Usage)
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("Invalid usage %s: %v", UsageName, err)
+	}
+	return files, nil
+}
+
+func (fs *trfs) SaveUsage() error {
+	if fs.usage == nil {
+		return &os.PathError{Op: "save usage", Path: UsageName, Err: errUsageNotTracked}
+	}
+	if err := fs.checkWritable("save usage", UsageName); err != nil {
+		return err
+	}
+	t, err := fs.usageTracker()
+	if err != nil {
+		return err
+	}
+	defer t.mu.Unlock()
+	data, err := json.Marshal(t.files)
+	if err != nil {
+		return err
+	}
+	// The persisted usage is replaced atomically, so it is never torn
+	tmp := usagePath() + ".new"
+	f, err := fs.Fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fs.Fs.Rename(tmp, usagePath())
+	}
+	if err != nil {
+		fs.Fs.Remove(tmp)
+		return err
+	}
+	t.persisted = true
+	return nil
+}
+
+// Records the usage of the file at path, a zero usage removes it
+func (t *usageTracker) set(path string, u Usage) {
+	d := u.sub(t.files[path])
+	if d == (Usage{}) {
+		return
+	}
+	if t.persisted {
+		// Retried with the next change if it fails
+		err := t.backing.Remove(usagePath())
+		t.persisted = err != nil && !os.IsNotExist(err)
+	}
+	addUsage(t.files, t.dirs, path, d)
+}
+
+// Adds d to the usage of the file at path and to the totals of its directories
+func addUsage(files, dirs map[string]Usage, path string, d Usage) {
+	if u := files[path].add(d); u == (Usage{}) {
+		delete(files, path)
+	} else {
+		files[path] = u
+	}
+	for dir := path; dir != filepath.Dir(dir); {
+		dir = filepath.Dir(dir)
+		dirs[dir] = dirs[dir].add(d)
+	}
+}
+
+// Returns the files at or below path
+func (t *usageTracker) below(path string) []string {
+	prefix := path + string(filepath.Separator)
+	var paths []string
+	for p := range t.files {
+		if p == path || strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Updates the usage of the regular file at the backing path
+func (fs *trfs) updateUsage(path, name string) {
+	if fs.usage == nil {
+		return
+	}
+	t, err := fs.usageTracker()
+	if err != nil {
+		return
+	}
+	defer t.mu.Unlock()
+	var u Usage
+	if info, err := fs.lstat(path); err == nil && isRegular(info) {
+		u = Usage{1, fs.fileInfo(info, name).Size(), info.Size()}
+	}
+	t.set(filepath.Clean(path), u)
+}
+
+// Forgets the usage of files at or below the backing path
+func (fs *trfs) dropUsage(path string) {
+	fs.moveUsage(path, "")
+}
+
+// Moves the usage of files at or below oldpath to newpath, or drops it
+func (fs *trfs) moveUsage(oldpath, newpath string) {
+	if fs.usage == nil {
+		return
+	}
+	t, err := fs.usageTracker()
+	if err != nil {
+		return
+	}
+	defer t.mu.Unlock()
+	oldpath = filepath.Clean(oldpath)
+	if newpath != "" {
+		newpath = filepath.Clean(newpath)
+		// Replaced files
+		for _, p := range t.below(newpath) {
+			t.set(p, Usage{})
+		}
+	}
+	for _, p := range t.below(oldpath) {
+		u := t.files[p]
+		t.set(p, Usage{})
+		if newpath != "" {
+			t.set(newpath+p[len(oldpath):], u)
+		}
+	}
+}
+
+/*
+Reserves growing the usage of the file at the backing path by grow until
+the returned func is called, once the change has been recorded. Fails with
+a QuotaError if the growth would exceed a quota, together with the growth
+reserved by other changes in progress.
+*/
+func (fs *trfs) reserve(op, name, path string, grow Usage) (func(), error) {
+	if len(fs.quotas) == 0 {
+		return func() {}, nil
+	}
+	t, err := fs.usageTracker()
+	if err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+	path = filepath.Clean(path)
+	for dir, limit := range fs.quotas {
+		qpath, err := fs.backingPath(dir)
+		if err != nil {
+			continue
+		}
+		qpath = filepath.Clean(qpath)
+		var u Usage
+		switch {
+		case qpath == path:
+			u = t.files[path].add(t.reserved[path])
+		case qpath == filepath.Dir(qpath) || strings.HasPrefix(path, qpath+string(filepath.Separator)):
+			u = t.dirs[qpath].add(t.reservedDirs[qpath])
+		default:
+			continue
+		}
+		u = u.add(grow)
+		if exceeds(u.Files, limit.Files, grow.Files) ||
+			exceeds(u.Bytes, limit.Bytes, grow.Bytes) ||
+			exceeds(u.StoredBytes, limit.StoredBytes, grow.StoredBytes) {
+			return nil, &os.PathError{Op: op, Path: name, Err: &QuotaError{dir, limit, u}}
+		}
+	}
+	addUsage(t.reserved, t.reservedDirs, path, grow)
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		addUsage(t.reserved, t.reservedDirs, path, Usage{}.sub(grow))
+	}, nil
+}
+
+func exceeds(value, limit, grow int64) bool {
+	return limit > 0 && grow > 0 && value > limit
+}
+
+// Reserves creating a file at the backing path within the quotas, like reserve
+func (fs *trfs) reserveCreate(name, path string, flag int) (func(), error) {
+	if len(fs.quotas) == 0 || flag&os.O_CREATE == 0 {
+		return func() {}, nil
+	}
+	if _, err := fs.lstat(path); !os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	return fs.reserve("open", name, path, Usage{Files: 1})
+}
+
+// Size of a transformed file of the given plaintext size in the backing filesystem
+func (fs *trfs) storedSize(size int64) int64 {
+	stored := size / fs.blockSize * fs.encodedBlockSize()
+	if rem := size % fs.blockSize; rem > 0 {
+		stored += rem + int64(fs.overhead)
+	}
+	return stored + int64(len(fs.header))
+}
+
+/*
+Reserves writing n bytes at off through the handle within the quotas. The
+returned func records the usage of the file after the write and releases
+the reservation. A negative off writes at the offset of the handle.
+*/
+func (f *file) reserve(op string, off, n int64) (func(), error) {
+	if f.fs.usage == nil {
+		return func() {}, nil
+	}
+	release := func() {}
+	if len(f.fs.quotas) > 0 {
+		info, err := f.File.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size := info.Size()
+		if off < 0 {
+			if off, err = f.File.Seek(0, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			if f.flag&os.O_APPEND != 0 {
+				off = size
+			}
+		}
+		end := max(size, off+n)
+		grow := Usage{Bytes: end - size, StoredBytes: end - size}
+		if _, ok := f.File.(*sharedFile); ok {
+			grow.StoredBytes = f.fs.storedSize(end) - f.fs.storedSize(size)
+		}
+		if release, err = f.fs.reserve(op, f.name, f.currentPath(), grow); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		f.recordUsage()
+		release()
+	}, nil
+}
+
+/*
+Records the usage of the file after a change through the handle. It is
+derived from the size of the file, so the backing file is not looked up.
+*/
+func (f *file) recordUsage() {
+	info, err := f.File.Stat()
+	if err != nil {
+		return
+	}
+	size := info.Size()
+	u := Usage{1, size, size}
+	if _, ok := f.File.(*sharedFile); ok {
+		u.StoredBytes = f.fs.storedSize(size)
+	}
+	t, err := f.fs.usageTracker()
+	if err != nil {
+		return
+	}
+	defer t.mu.Unlock()
+	path := filepath.Clean(f.currentPath())
+	// Removed meanwhile
+	if _, ok := t.files[path]; !ok {
+		return
+	}
+	t.set(path, u)
+}
@@ -0,0 +1,165 @@
+package trfs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func usage(t *testing.T, fs afero.Fs, name string) trfs.Usage {
+	u, err := fs.(trfs.UsageReporter).Usage(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestUsage(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	// Files written before usage is tracked are found by a scan
+	afero.WriteFile(naclfs.New(16, Key("usage"), backing), "/a/file", make([]byte, 40), 0644)
+
+	fs := naclfs.New(16, Key("usage"), backing, trfs.WithUsage())
+	overhead := int64(naclfs.NewCodec(Key("usage")).Overhead)
+	if u := usage(t, fs, "/"); u != (trfs.Usage{Files: 1, Bytes: 40, StoredBytes: 40 + 3*overhead}) {
+		t.Errorf("Unexpected usage after scan %+v", u)
+	}
+	afero.WriteFile(fs, "/a/b/other", make([]byte, 10), 0644)
+	if u := usage(t, fs, "/a"); u != (trfs.Usage{Files: 2, Bytes: 50, StoredBytes: 50 + 4*overhead}) {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+	if u := usage(t, fs, "/a/b/other"); u.Bytes != 10 {
+		t.Errorf("Unexpected usage of file %+v", u)
+	}
+	fs.Rename("/a/b", "/c")
+	fs.Remove("/a/file")
+	if u := usage(t, fs, "/a"); u != (trfs.Usage{}) {
+		t.Errorf("Unexpected usage after remove %+v", u)
+	}
+	if u := usage(t, fs, "/"); u.Files != 1 || u.Bytes != 10 {
+		t.Errorf("Unexpected usage after rename %+v", u)
+	}
+
+	if _, err := naclfs.New(16, Key("usage"), backing).(trfs.UsageReporter).Usage("/"); err == nil {
+		t.Errorf("Usage should fail unless tracked")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	fs := naclfs.New(16, Key("quota"), afero.NewMemMapFs(),
+		trfs.WithQuota("/limited", trfs.Usage{Bytes: 100}),
+		trfs.WithQuota("/few", trfs.Usage{Files: 2}))
+	fs.Mkdir("/limited", 0755)
+	f, err := fs.Create("/limited/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, 90)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 20))
+	var quotaErr *trfs.QuotaError
+	if !errors.As(err, &quotaErr) || quotaErr.Dir != "/limited" || quotaErr.Usage.Bytes != 110 {
+		t.Errorf("Expected quota error, got %v", err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte("x"), 10), 0); err != nil {
+		t.Errorf("Overwriting should not grow usage: %v", err)
+	}
+	if err := f.Truncate(200); err == nil {
+		t.Errorf("Growing beyond the quota should fail")
+	}
+	if err := f.Truncate(10); err != nil {
+		t.Errorf("Shrinking should succeed: %v", err)
+	}
+	if err := afero.WriteFile(fs, "/unlimited", make([]byte, 200), 0644); err != nil {
+		t.Errorf("Files outside the quota should not be limited: %v", err)
+	}
+
+	fs.Mkdir("/few", 0755)
+	for i, name := range []string{"/few/1", "/few/2", "/few/3"} {
+		_, err := fs.Create(name)
+		if (err != nil) != (i == 2) {
+			t.Errorf("Unexpected result creating %s: %v", name, err)
+		}
+	}
+	if _, err := fs.OpenFile("/few/1", os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		t.Errorf("Opening an existing file should not count: %v", err)
+	}
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	fs := naclfs.New(16, Key("quota"), afero.NewMemMapFs(),
+		trfs.WithQuota("/", trfs.Usage{Bytes: 100}))
+	var files []afero.File
+	for i := 0; i < 20; i++ {
+		f, err := fs.Create(fmt.Sprintf("/%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	var wg sync.WaitGroup
+	written := make(chan bool, len(files))
+	for _, f := range files {
+		wg.Add(1)
+		go func(f afero.File) {
+			defer wg.Done()
+			_, err := f.Write(make([]byte, 20))
+			written <- err == nil
+		}(f)
+	}
+	wg.Wait()
+	close(written)
+	n := 0
+	for ok := range written {
+		if ok {
+			n++
+		}
+	}
+	if n != 5 {
+		t.Errorf("Expected 5 writes within the quota, got %d", n)
+	}
+	if u := usage(t, fs, "/"); u.Bytes != 100 {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+}
+
+func TestUsagePersisted(t *testing.T) {
+	backing := afero.NewMemMapFs()
+	fs := naclfs.New(16, Key("usage"), backing, trfs.WithUsage())
+	afero.WriteFile(fs, "/file", make([]byte, 40), 0644)
+	if err := fs.(trfs.UsageReporter).SaveUsage(); err != nil {
+		t.Fatal(err)
+	}
+	// Not noticed, as the persisted usage is loaded instead of scanning
+	afero.WriteFile(naclfs.New(16, Key("usage"), backing), "/unnoticed", make([]byte, 10), 0644)
+	loaded := naclfs.New(16, Key("usage"), backing, trfs.WithUsage())
+	if u := usage(t, loaded, "/"); u.Files != 1 || u.Bytes != 40 {
+		t.Errorf("Unexpected loaded usage %+v", u)
+	}
+	if names, _ := afero.ReadDir(loaded, "/"); len(names) != 2 {
+		t.Errorf("Persisted usage should be hidden, got %d entries", len(names))
+	}
+
+	// A change removes the persisted usage
+	afero.WriteFile(loaded, "/other", make([]byte, 5), 0644)
+	if u := usage(t, loaded, "/"); u.Files != 2 || u.Bytes != 45 {
+		t.Errorf("Unexpected usage after change %+v", u)
+	}
+	if _, err := backing.Stat(trfs.UsageName); !os.IsNotExist(err) {
+		t.Errorf("Persisted usage should be removed by a change: %v", err)
+	}
+	scanned := naclfs.New(16, Key("usage"), backing, trfs.WithUsage())
+	if u := usage(t, scanned, "/"); u.Files != 3 || u.Bytes != 55 {
+		t.Errorf("Unexpected scanned usage %+v", u)
+	}
+}
@@ -0,0 +1,211 @@
+package trfs
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR | syscall.IN_EXCL_UNLINK
+
+// Watches a backing directory tree with inotify
+type watcher struct {
+	fs     *trfs
+	fn     func(Event)
+	fd     int
+	notify *os.File
+	// Watched directories by watch descriptor
+	dirs map[int32]*watchedDir
+	// Source of a rename waiting for its destination
+	moved *movedEntry
+	done  sync.WaitGroup
+}
+
+type watchedDir struct {
+	path, name string
+}
+
+type movedEntry struct {
+	cookie     uint32
+	path, name string
+	dir        bool
+}
+
+func (fs *trfs) Watch(name string, fn func(Event)) (io.Closer, error) {
+	path, err := fs.backingPath(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "watch", Path: name, Err: err}
+	}
+	if _, ok := fs.osPath(path); !ok {
+		return nil, &os.PathError{Op: "watch", Path: name, Err: ErrWatchUnsupported}
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, &os.PathError{Op: "watch", Path: name, Err: err}
+	}
+	w := &watcher{
+		fs:     fs,
+		fn:     fn,
+		fd:     fd,
+		notify: os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]*watchedDir),
+	}
+	if err := w.add(path, filepath.Clean(name)); err != nil {
+		w.notify.Close()
+		return nil, &os.PathError{Op: "watch", Path: name, Err: err}
+	}
+	w.done.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Stops watching and waits until no more events are reported
+func (w *watcher) Close() error {
+	err := w.notify.Close()
+	w.done.Wait()
+	return err
+}
+
+// Watches the backing directory at path and the directories below it
+func (w *watcher) add(path, name string) error {
+	osPath, ok := w.fs.osPath(path)
+	if !ok {
+		return ErrWatchUnsupported
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, osPath, watchMask)
+	if err != nil {
+		return err
+	}
+	w.dirs[int32(wd)] = &watchedDir{path, name}
+	d, err := w.fs.Fs.Open(path)
+	if err != nil {
+		return err
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if plain, ok := w.fs.entryName(path, info.Name()); ok {
+			// Directories removed meanwhile have been reported
+			w.add(filepath.Join(path, info.Name()), filepath.Join(name, plain))
+		}
+	}
+	return nil
+}
+
+// Stops watching the directories at or below path
+func (w *watcher) drop(path string) {
+	prefix := path + string(filepath.Separator)
+	for wd, d := range w.dirs {
+		if d.path == path || strings.HasPrefix(d.path, prefix) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// Updates the paths of watched directories after a rename
+func (w *watcher) move(oldpath, oldname, newpath, newname string) {
+	prefix := oldpath + string(filepath.Separator)
+	for _, d := range w.dirs {
+		if d.path == oldpath || strings.HasPrefix(d.path, prefix) {
+			d.path = newpath + d.path[len(oldpath):]
+			d.name = newname + d.name[len(oldname):]
+		}
+	}
+}
+
+func (w *watcher) run() {
+	defer w.done.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.notify.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			cookie := binary.NativeEndian.Uint32(buf[off+8:])
+			size := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			off += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[off:off+size]), "\x00")
+			off += size
+			w.handle(wd, mask, cookie, name)
+		}
+		// Files moved out of the tree have no destination
+		w.flushMoved()
+	}
+}
+
+func (w *watcher) handle(wd int32, mask, cookie uint32, name string) {
+	if mask&syscall.IN_MOVED_TO == 0 || w.moved == nil || w.moved.cookie != cookie {
+		w.flushMoved()
+	}
+	d, ok := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		return
+	}
+	if !ok || name == "" {
+		return
+	}
+	plain, ok := w.fs.entryName(d.path, name)
+	if !ok {
+		return
+	}
+	path, plain := filepath.Join(d.path, name), filepath.Join(d.name, plain)
+	isDir := mask&syscall.IN_ISDIR != 0
+	switch {
+	case mask&syscall.IN_MOVED_FROM != 0:
+		w.moved = &movedEntry{cookie, path, plain, isDir}
+	case mask&syscall.IN_MOVED_TO != 0 && w.moved != nil:
+		moved := w.moved
+		w.moved = nil
+		if moved.dir {
+			w.move(moved.path, moved.name, path, plain)
+		}
+		w.emit(Event{Op: EventRename, Name: plain, OldName: moved.name})
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		if isDir {
+			w.add(path, plain)
+		}
+		w.emit(Event{Op: EventCreate, Name: plain})
+	case mask&syscall.IN_MODIFY != 0:
+		w.emit(Event{Op: EventWrite, Name: plain})
+	case mask&syscall.IN_DELETE != 0:
+		w.emit(Event{Op: EventRemove, Name: plain})
+	}
+}
+
+// Reports a pending rename source as removed
+func (w *watcher) flushMoved() {
+	moved := w.moved
+	if moved == nil {
+		return
+	}
+	w.moved = nil
+	if moved.dir {
+		w.drop(moved.path)
+	}
+	w.emit(Event{Op: EventRemove, Name: moved.name})
+}
+
+func (w *watcher) emit(ev Event) {
+	if ev.Op != EventRemove {
+		if info, err := w.fs.Stat(ev.Name); err == nil && !info.IsDir() {
+			ev.Size = info.Size()
+		}
+	}
+	w.fn(ev)
+}
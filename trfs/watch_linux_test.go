@@ -0,0 +1,67 @@
+package trfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tobiash/go-transformfile/naclfs"
+	"github.com/tobiash/go-transformfile/trfs"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trfs-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newFs := func() afero.Fs {
+		backing := afero.NewBasePathFs(afero.NewOsFs(), dir)
+		return naclfs.New(16, Key("watch"), backing, naclfs.WithNameEncryption(Key("watch")))
+	}
+	fs := newFs()
+	fs.Mkdir("/dir", 0755)
+
+	events := make(chan trfs.Event, 100)
+	w, err := fs.(trfs.Notifier).Watch("/", func(ev trfs.Event) {
+		events <- ev
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Changes made by another filesystem are only seen through the backing directory
+	other := newFs()
+	afero.WriteFile(other, "/dir/file", []byte("secret"), 0644)
+	other.Rename("/dir/file", "/dir/renamed")
+	other.Remove("/dir/renamed")
+
+	expected := []string{
+		"create /dir/file",
+		"write /dir/file",
+		"rename /dir/file->/dir/renamed",
+		"remove /dir/renamed",
+	}
+	var seen []string
+	timeout := time.After(5 * time.Second)
+	for len(expected) > 0 {
+		select {
+		case ev := <-events:
+			s := eventString(ev)
+			seen = append(seen, s)
+			if strings.HasPrefix(s, expected[0]) {
+				expected = expected[1:]
+			}
+		case <-timeout:
+			t.Fatalf("Missing events %q, seen %q", expected, seen)
+		}
+	}
+
+	if _, err := naclfs.New(16, Key("watch"), afero.NewMemMapFs()).(trfs.Notifier).Watch("/", func(trfs.Event) {}); err == nil {
+		t.Errorf("Watching a memory filesystem should fail")
+	}
+}
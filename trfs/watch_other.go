@@ -0,0 +1,12 @@
+//go:build !linux
+
+package trfs
+
+import (
+	"io"
+	"os"
+)
+
+func (fs *trfs) Watch(name string, fn func(Event)) (io.Closer, error) {
+	return nil, &os.PathError{Op: "watch", Path: name, Err: ErrWatchUnsupported}
+}